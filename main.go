@@ -8,16 +8,20 @@ import (
 
 	"fmt"
 	"galacticApps/mastodon"
+	"galacticApps/middleware"
+	"galacticApps/signaling"
 	"html/template"
 
 	"io/fs"
 	"log"
 	"mime"
+	"net"
 	"net/http"
-	"sync"
+	"syscall"
 	"time"
 
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 
@@ -33,24 +37,6 @@ import (
 //go:embed templates/* static/*
 var files embed.FS
 
-// SignalMessage is the JSON shape used to exchange signaling payloads between peers
-type SignalMessage struct {
-	Code string          `json:"code"`
-	From string          `json:"from"`
-	To   string          `json:"to,omitempty"`
-	Type string          `json:"type"`
-	Data json.RawMessage `json:"data,omitempty"`
-}
-
-// Peer represents a participant waiting in a room (in-memory)
-type Peer struct {
-	Name     string
-	Code     string
-	IP       string
-	Queue    []SignalMessage
-	LastSeen time.Time
-}
-
 func main() {
 	// Create the minifier instance and add the CSS and JS minifiers.
 	m := minify.New()
@@ -83,6 +69,17 @@ func main() {
 		logger.Println("Warning: failed to load mastodon servers:", err)
 	}
 
+	// Authorizations that are started but never completed expire
+	go mastodon.SweepOAuthStates()
+
+	// MASTODON_SESSIONS=true keeps access tokens in server-side sessions and
+	// proxies the instance API instead of handing tokens to the browser
+	if mastodon.SessionMode() {
+		if err := mastodon.InitSessions(logger); err != nil {
+			logger.Fatal("Failed to set up mastodon sessions:", err)
+		}
+	}
+
 	if !isDev {
 		staticFS, err := fs.Sub(files, "static")
 		if err != nil {
@@ -158,152 +155,101 @@ func main() {
 		setSecurityHeaders(w)
 		mastodon.OauthCallbackHandler(w, r, logger)
 	})
+	http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		setSecurityHeaders(w)
+		mastodon.LogoutHandler(w, r, logger)
+	})
 
-	// Simple HTTP-based signaling endpoints for WebRTC (polling-based signaling)
-	// In-memory store: rooms[code][name] -> *Peer
-	var rooms = make(map[string]map[string]*Peer)
-	var roomsMu sync.Mutex
+	if mastodon.SessionMode() {
+		http.HandleFunc("/api/mastodon/", func(w http.ResponseWriter, r *http.Request) {
+			setSecurityHeaders(w)
+			mastodon.SessionProxyHandler(w, r, logger)
+		})
+	}
 
-	http.HandleFunc("/webrtc/join", func(w http.ResponseWriter, r *http.Request) {
-		setSecurityHeaders(w)
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		var req struct {
-			Name string `json:"name"`
-			Code string `json:"code"`
-			IP   string `json:"ip,omitempty"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
-			return
-		}
-		if req.Code == "" || req.Name == "" {
-			http.Error(w, "missing name or code", http.StatusBadRequest)
-			return
-		}
+	// Clients are identified by their own address unless they come through
+	// one of the reverse proxies listed in TRUSTED_PROXIES
+	if err := middleware.SetTrustedProxies(os.Getenv("TRUSTED_PROXIES"), logger); err != nil {
+		logger.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
 
-		roomsMu.Lock()
-		defer roomsMu.Unlock()
-		room := rooms[req.Code]
-		if room == nil {
-			room = make(map[string]*Peer)
-			rooms[req.Code] = room
-		}
-		p := &Peer{
-			Name:     req.Name,
-			Code:     req.Code,
-			IP:       req.IP,
-			Queue:    []SignalMessage{},
-			LastSeen: time.Now(),
+	// WebRTC signaling rooms live in memory unless WEBRTC_STORE_PATH points at
+	// a SQLite database, in which case they survive restarts
+	// closers are released on shutdown, which ends in os.Exit and so never
+	// runs deferred calls
+	var closers []io.Closer
+	var signalStore signaling.Store = signaling.NewMemoryStore()
+	persistentRooms := os.Getenv("WEBRTC_STORE_PATH") != ""
+	if persistentRooms {
+		sqliteStore, err := signaling.OpenSQLiteStore(os.Getenv("WEBRTC_STORE_PATH"))
+		if err != nil {
+			logger.Fatal("Failed to open signaling store:", err)
 		}
-		room[req.Name] = p
+		closers = append(closers, sqliteStore)
+		signalStore = sqliteStore
+	}
 
-		// return list of other participants
-		others := []string{}
-		for n := range room {
-			if n != req.Name {
-				others = append(others, n)
-			}
+	// Replicas share room traffic through Redis when WEBRTC_REDIS_URL is set;
+	// otherwise everything stays inside this process
+	var broker signaling.Broker = signaling.NewLocalBroker()
+	if redisURL := os.Getenv("WEBRTC_REDIS_URL"); redisURL != "" {
+		redisBroker, err := signaling.NewRedisBroker(redisURL, logger)
+		if err != nil {
+			logger.Fatal("Invalid WEBRTC_REDIS_URL:", err)
 		}
-		_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "peers": others})
-	})
+		closers = append(closers, redisBroker)
+		broker = redisBroker
+	}
 
-	http.HandleFunc("/webrtc/signal", func(w http.ResponseWriter, r *http.Request) {
-		setSecurityHeaders(w)
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		var msg SignalMessage
-		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
-			return
-		}
-		if msg.Code == "" || msg.From == "" || msg.Type == "" {
-			http.Error(w, "missing fields", http.StatusBadRequest)
-			return
-		}
+	signalConfig := signaling.ConfigFromEnv()
 
-		roomsMu.Lock()
-		defer roomsMu.Unlock()
-		room := rooms[msg.Code]
-		if room == nil {
-			http.Error(w, "room not found", http.StatusNotFound)
-			return
+	// STUN_PORT turns on the embedded STUN responder, which is then offered
+	// to clients ahead of any external STUN servers
+	if stunPort := os.Getenv("STUN_PORT"); stunPort != "" {
+		stunConn, err := net.ListenPacket("udp", ":"+stunPort)
+		if err != nil {
+			logger.Fatal("Failed to listen for STUN:", err)
 		}
-
-		// if To specified, deliver to that participant, otherwise broadcast to others
-		if msg.To != "" {
-			if target, ok := room[msg.To]; ok {
-				target.Queue = append(target.Queue, msg)
-			} else {
-				http.Error(w, "target not found", http.StatusNotFound)
-				return
+		signalConfig.ICE.LocalSTUNPort = stunConn.LocalAddr().(*net.UDPAddr).Port
+		go func() {
+			if err := signaling.ServeSTUN(stunConn, logger); err != nil {
+				logger.Println("stun:", err)
 			}
-		} else {
-			for name, peer := range room {
-				if name == msg.From {
-					continue
-				}
-				peer.Queue = append(peer.Queue, msg)
-			}
-		}
-		_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
-	})
+		}()
+	}
 
-	http.HandleFunc("/webrtc/poll", func(w http.ResponseWriter, r *http.Request) {
-		setSecurityHeaders(w)
-		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		code := r.URL.Query().Get("code")
-		name := r.URL.Query().Get("name")
-		if code == "" || name == "" {
-			http.Error(w, "missing code or name", http.StatusBadRequest)
-			return
-		}
-		roomsMu.Lock()
-		defer roomsMu.Unlock()
-		room := rooms[code]
-		if room == nil {
-			_ = json.NewEncoder(w).Encode([]SignalMessage{})
-			return
-		}
-		peer := room[name]
-		if peer == nil {
-			_ = json.NewEncoder(w).Encode([]SignalMessage{})
-			return
-		}
-		msgs := peer.Queue
-		peer.Queue = []SignalMessage{}
-		peer.LastSeen = time.Now()
-		_ = json.NewEncoder(w).Encode(msgs)
-	})
+	hub, err := signaling.NewHub(signalStore, broker, signalConfig, logger)
+	if err != nil {
+		logger.Fatal("Failed to start signaling hub:", err)
+	}
+	go hub.Run()
 
-	http.HandleFunc("/webrtc/leave", func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/webrtc/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		setSecurityHeaders(w)
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		var req struct{ Name, Code string }
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
-			return
+		hub.ServeHTTP(w, r)
+	}))
+
+	// On shutdown close every in-memory room so connected clients hear
+	// room-closed and rejoin, rather than waiting on a server that is no
+	// longer there. Persistent rooms are left for the next start to resume.
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if !persistentRooms {
+			if err := hub.CloseAll(); err != nil {
+				logger.Println("webrtc: failed to close rooms:", err)
+			}
+			// give sockets and parked long-polls a moment to flush
+			time.Sleep(time.Second)
 		}
-		roomsMu.Lock()
-		defer roomsMu.Unlock()
-		if room := rooms[req.Code]; room != nil {
-			delete(room, req.Name)
-			if len(room) == 0 {
-				delete(rooms, req.Code)
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i].Close(); err != nil {
+				logger.Println("shutdown:", err)
 			}
 		}
-		_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
-	})
+		os.Exit(0)
+	}()
 
 	port := os.Getenv("PORT")
 	if port == "" {
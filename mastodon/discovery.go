@@ -0,0 +1,172 @@
+package mastodon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxProbeBody caps what is read from each discovery document
+const maxProbeBody = 1 << 20
+
+// probeClient fetches the documents an instance is identified by
+var probeClient = &http.Client{Timeout: 10 * time.Second}
+
+// supportedSoftware are the servers whose Mastodon client API nebulink works with
+var supportedSoftware = []string{"mastodon", "gotosocial", "akkoma", "pleroma", "pixelfed"}
+
+var (
+	// ErrUnreachable means the instance could not be probed at all
+	ErrUnreachable = errors.New("instance unreachable")
+	// ErrIncompatible means the instance runs software without a Mastodon client API
+	ErrIncompatible = errors.New("incompatible server")
+)
+
+// Capabilities is what probing found out about an instance
+type Capabilities struct {
+	Software       string    `json:"software"`
+	Version        string    `json:"version"`
+	MaxCharacters  int       `json:"max_characters"`
+	Translation    bool      `json:"translation"`
+	GranularScopes bool      `json:"granular_scopes"`
+	Probed         time.Time `json:"probed"`
+	// PKCE is whether the instance advertises S256 PKCE; it is nil for
+	// instances probed before it was recorded
+	PKCE *bool `json:"pkce,omitempty"`
+}
+
+// probeTTL is how long what probing found out about an instance is trusted
+const probeTTL = 24 * time.Hour
+
+// outdated reports whether c is missing, older than probeTTL or from before
+// PKCE support was recorded, and the instance should be probed again
+func (c *Capabilities) outdated(now time.Time) bool {
+	return c == nil || c.PKCE == nil || now.Sub(c.Probed) > probeTTL
+}
+
+// compatibleVersion matches the "(compatible; Akkoma 3.10.0)" suffix
+// Mastodon API implementations put in their instance version
+var compatibleVersion = regexp.MustCompile(`\(compatible; ([^ )]+) ?([^)]*)\)`)
+
+// probeInstance identifies the software of domain from its NodeInfo and
+// reads its limits from /api/v2/instance, falling back to v1. It fails with
+// ErrIncompatible for software nebulink cannot talk to.
+func probeInstance(domain string) (*Capabilities, error) {
+	caps := &Capabilities{MaxCharacters: 500, Probed: time.Now()}
+	caps.Software, caps.Version = nodeInfo(domain)
+	if caps.Software != "" && !slices.Contains(supportedSoftware, caps.Software) {
+		return nil, fmt.Errorf("%w: %s is not supported", ErrIncompatible, caps.Software)
+	}
+
+	var instance struct {
+		Version       string `json:"version"`
+		MaxTootChars  int    `json:"max_toot_chars"` // Pleroma and Akkoma
+		Configuration struct {
+			Statuses struct {
+				MaxCharacters int `json:"max_characters"`
+			} `json:"statuses"`
+			Translation struct {
+				Enabled bool `json:"enabled"`
+			} `json:"translation"`
+		} `json:"configuration"`
+	}
+	err := probeJSON(fmt.Sprintf("https://%s/api/v2/instance", domain), &instance)
+	if err != nil {
+		err = probeJSON(fmt.Sprintf("https://%s/api/v1/instance", domain), &instance)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return nil, ErrUnreachable
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s does not serve the Mastodon API", ErrIncompatible, domain)
+	}
+	if instance.Version == "" {
+		return nil, fmt.Errorf("%w: %s does not serve the Mastodon API", ErrIncompatible, domain)
+	}
+
+	// without NodeInfo, go by the version string
+	if caps.Software == "" {
+		caps.Software, caps.Version = "mastodon", instance.Version
+		if m := compatibleVersion.FindStringSubmatch(instance.Version); m != nil {
+			caps.Software, caps.Version = strings.ToLower(m[1]), m[2]
+		}
+		if !slices.Contains(supportedSoftware, caps.Software) {
+			return nil, fmt.Errorf("%w: %s is not supported", ErrIncompatible, caps.Software)
+		}
+	}
+	if n := instance.Configuration.Statuses.MaxCharacters; n > 0 {
+		caps.MaxCharacters = n
+	} else if instance.MaxTootChars > 0 {
+		caps.MaxCharacters = instance.MaxTootChars
+	}
+	caps.Translation = instance.Configuration.Translation.Enabled
+
+	// Mastodon has had granular scopes since long before it published OAuth
+	// metadata; anyone else has to advertise them. Older servers have no
+	// metadata and simply ignore PKCE.
+	pkce := false
+	if meta, err := authServerMetadata(domain); err == nil {
+		caps.GranularScopes = slices.Contains(meta.ScopesSupported, "read:statuses")
+		pkce = slices.Contains(meta.CodeChallengeMethods, "S256")
+	}
+	caps.PKCE = &pkce
+	caps.GranularScopes = caps.GranularScopes || caps.Software == "mastodon"
+	return caps, nil
+}
+
+// nodeInfo returns the software name and version domain reports through
+// NodeInfo, or empty strings if it does not
+func nodeInfo(domain string) (software, version string) {
+	var index struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := probeJSON(fmt.Sprintf("https://%s/.well-known/nodeinfo", domain), &index); err != nil {
+		return "", ""
+	}
+	for _, link := range index.Links {
+		// only follow links on the instance itself
+		if !strings.HasPrefix(link.Rel, "http://nodeinfo.diaspora.software/ns/schema/2.") ||
+			!strings.HasPrefix(link.Href, "https://"+domain+"/") {
+			continue
+		}
+		var info struct {
+			Software struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"software"`
+		}
+		if err := probeJSON(link.Href, &info); err == nil && info.Software.Name != "" {
+			return strings.ToLower(info.Software.Name), info.Software.Version
+		}
+	}
+	return "", ""
+}
+
+// probeJSON decodes the JSON document at url into v
+func probeJSON(url string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxProbeBody)).Decode(v)
+}
@@ -0,0 +1,27 @@
+package mastodon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCapabilitiesOutdated(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	yes, no := true, false
+	tests := []struct {
+		name string
+		caps *Capabilities
+		want bool
+	}{
+		{"never probed", nil, true},
+		{"probed before PKCE was recorded", &Capabilities{Probed: now}, true},
+		{"fresh", &Capabilities{PKCE: &yes, Probed: now.Add(-time.Hour)}, false},
+		{"fresh without PKCE", &Capabilities{PKCE: &no, Probed: now.Add(-time.Hour)}, false},
+		{"past the TTL", &Capabilities{PKCE: &yes, Probed: now.Add(-probeTTL - time.Second)}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.caps.outdated(now); got != tt.want {
+			t.Errorf("%s: outdated = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
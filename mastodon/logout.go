@@ -0,0 +1,88 @@
+package mastodon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var revokeClient = &http.Client{Timeout: 10 * time.Second}
+
+// LogoutHandler ends a login by revoking its access token at the instance.
+// In session mode the body names the account handle and the login is also
+// dropped from the session; otherwise the browser hands over the instance
+// domain and the token it holds. The response reports whether the instance
+// accepted the revocation.
+func LogoutHandler(w http.ResponseWriter, r *http.Request, logger *log.Logger) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	var req struct {
+		Account  string `json:"account,omitempty"`
+		Instance string `json:"instance,omitempty"`
+		Token    string `json:"token,omitempty"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	instance, token := req.Instance, req.Token
+	if SessionMode() {
+		var ok bool
+		if instance, token, ok = sessionToken(r, req.Account); !ok {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		if err := forgetSessionAccount(r, req.Account); err != nil {
+			logger.Println("failed to save sessions:", err)
+		}
+	}
+	if instance == "" || token == "" {
+		http.Error(w, "missing instance or token", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := revokeToken(instance, token); err != nil {
+		logger.Println("token revocation failed:", err)
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "revoked": false, "error": err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "revoked": true})
+}
+
+// revokeToken asks instance to revoke token using the client credentials
+// registered for it
+func revokeToken(instance, token string) error {
+	mastodonMu.RLock()
+	entry, ok := mastodonServers[instance]
+	mastodonMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no app registration for %s", instance)
+	}
+
+	data := url.Values{}
+	data.Set("client_id", entry.ID)
+	data.Set("client_secret", entry.Secret)
+	data.Set("token", token)
+	resp, err := revokeClient.Post(fmt.Sprintf("https://%s/oauth/revoke", instance), "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("instance answered %s", resp.Status)
+	}
+	return nil
+}
@@ -3,16 +3,21 @@ package mastodon
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type AppRegistrationRequest struct {
@@ -33,6 +38,10 @@ func AuthNebuLinkHandler(w http.ResponseWriter, r *http.Request, logger *log.Log
 		http.Error(w, "Invalid request: missing instance_domain", http.StatusBadRequest)
 		return
 	}
+	if !validInstanceDomain(instanceDomain) {
+		http.Error(w, "Invalid request: instance_domain is not a hostname", http.StatusBadRequest)
+		return
+	}
 
 	// If we already have credentials for this domain, use them; otherwise register
 	mastodonMu.RLock()
@@ -47,6 +56,17 @@ func AuthNebuLinkHandler(w http.ResponseWriter, r *http.Request, logger *log.Log
 	}
 
 	if !ok {
+		// Make sure there is a server we can talk to before registering with it
+		caps, err := probeInstance(instanceDomain)
+		if errors.Is(err, ErrIncompatible) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "instance unreachable", http.StatusBadGateway)
+			return
+		}
+
 		// Register the app with the instance
 		instanceURL := fmt.Sprintf("https://%s/api/v1/apps", instanceDomain)
 
@@ -78,9 +98,10 @@ func AuthNebuLinkHandler(w http.ResponseWriter, r *http.Request, logger *log.Log
 		// Persist the newly registered client id/secret for future reuse
 		mastodonMu.Lock()
 		mastodonServers[instanceDomain] = ServerEntry{
-			Domain: instanceDomain,
-			ID:     appResp.ClientID,
-			Secret: appResp.ClientSecret,
+			Domain:       instanceDomain,
+			ID:           appResp.ClientID,
+			Secret:       appResp.ClientSecret,
+			Capabilities: caps,
 		}
 
 		_ = SaveMastodonServers()
@@ -88,16 +109,72 @@ func AuthNebuLinkHandler(w http.ResponseWriter, r *http.Request, logger *log.Log
 
 		entry = mastodonServers[instanceDomain]
 
+	} else if entry.Capabilities.outdated(time.Now()) {
+		// Registered before probing, or probed too long ago; it worked
+		// then, so only record what it can do now
+		if caps, err := probeInstance(instanceDomain); err == nil {
+			mastodonMu.Lock()
+			entry.Capabilities = caps
+			mastodonServers[instanceDomain] = entry
+			_ = SaveMastodonServers()
+			mastodonMu.Unlock()
+		}
+	}
+
+	// Tie the state to this browser with a short-lived cookie, so a leaked
+	// state cannot complete the flow anywhere else
+	binding, err := genState()
+	if err != nil {
+		http.Error(w, "failed to generate state", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthCookie,
+		Value:    binding,
+		Path:     "/callback",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		// the callback is a cross-site navigation from the instance
+		SameSite: http.SameSiteLaxMode,
+		Secure:   secureCookies(),
+	})
+
+	// Use PKCE where the instance supports it, so an intercepted code is
+	// useless without the verifier that only this server holds
+	pending := oauthState{Instance: instanceDomain, Binding: binding, Expires: time.Now().Add(oauthStateTTL)}
+	usePKCE := entry.Capabilities != nil && entry.Capabilities.PKCE != nil && *entry.Capabilities.PKCE
+	if !usePKCE && supportsPKCE(instanceDomain) {
+		// a cached "no" may be a metadata fetch that failed or a server
+		// upgraded since, so it is always checked again
+		usePKCE = true
+		if entry.Capabilities != nil {
+			mastodonMu.Lock()
+			caps := *entry.Capabilities
+			caps.PKCE = &usePKCE
+			entry.Capabilities = &caps
+			mastodonServers[instanceDomain] = entry
+			_ = SaveMastodonServers()
+			mastodonMu.Unlock()
+		}
+	}
+	if usePKCE {
+		if pending.Verifier, err = genVerifier(); err != nil {
+			http.Error(w, "failed to generate code verifier", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	oauthStatesMu.Lock()
-	oauthStates[state] = instanceDomain
+	oauthStates[state] = pending
 	oauthStatesMu.Unlock()
 
 	authorizeURL := fmt.Sprintf("https://%s/oauth/authorize?client_id=%s&redirect_uri=%s&response_type=code&scope=read+write+push&state=%s", instanceDomain, url.QueryEscape(entry.ID), url.QueryEscape(getCallbackURL()), url.QueryEscape(state))
+	if pending.Verifier != "" {
+		authorizeURL += "&code_challenge=" + codeChallenge(pending.Verifier) + "&code_challenge_method=S256"
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]string{"authorize_url": authorizeURL})
+	_ = json.NewEncoder(w).Encode(map[string]any{"authorize_url": authorizeURL, "server": entry.Capabilities})
 }
 
 // Helper to parse instance_domain from form or JSON
@@ -143,15 +220,51 @@ type ServerEntry struct {
 	Domain string `json:"domain"`
 	ID     string `json:"id"`
 	Secret string `json:"secret"`
+	// Capabilities is what probeInstance found before registering
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
 }
 
 var (
 	mastodonServers = make(map[string]ServerEntry)
 	mastodonMu      sync.RWMutex
-	oauthStates     = make(map[string]string) // state -> instanceDomain
+	oauthStates     = make(map[string]oauthState) // state -> pending authorization
 	oauthStatesMu   sync.RWMutex
 )
 
+// oauthStateTTL is how long a user has to finish logging in at their instance
+const oauthStateTTL = 10 * time.Minute
+
+// oauthCookie binds a pending authorization to the browser that started it
+const oauthCookie = "nebulink_oauth"
+
+// oauthState is what an authorization started by AuthNebuLinkHandler needs
+// when it comes back to OauthCallbackHandler
+type oauthState struct {
+	Instance string
+	// Verifier is the PKCE code_verifier, empty when the instance does not
+	// advertise PKCE support
+	Verifier string
+	// Binding must match the oauthCookie of the browser completing the flow
+	Binding string
+	Expires time.Time
+}
+
+// SweepOAuthStates periodically drops authorizations that were started but
+// never completed
+func SweepOAuthStates() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		oauthStatesMu.Lock()
+		for state, pending := range oauthStates {
+			if now.After(pending.Expires) {
+				delete(oauthStates, state)
+			}
+		}
+		oauthStatesMu.Unlock()
+	}
+}
+
 // LoadMastodonServers reads the JSON file and populates the mastodonServers map
 func LoadMastodonServers() error {
 	data, err := os.ReadFile(os.Getenv("MASTODON_STORE_PATH"))
@@ -206,12 +319,18 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request, logger *log.Lo
 		return
 	}
 
-	// Lookup which instance this state belongs to
-	oauthStatesMu.RLock()
-	instance, ok := oauthStates[state]
+	// Lookup which instance this state belongs to; a state is good for one
+	// callback only, whatever its outcome
+	oauthStatesMu.Lock()
+	pending, ok := oauthStates[state]
+	delete(oauthStates, state)
+	oauthStatesMu.Unlock()
+	instance := pending.Instance
 
-	oauthStatesMu.RUnlock()
-	if !ok {
+	binding, err := r.Cookie(oauthCookie)
+	http.SetCookie(w, &http.Cookie{Name: oauthCookie, Path: "/callback", MaxAge: -1, HttpOnly: true, Secure: secureCookies()})
+	if !ok || time.Now().After(pending.Expires) || err != nil ||
+		subtle.ConstantTimeCompare([]byte(binding.Value), []byte(pending.Binding)) != 1 {
 		http.Error(w, "invalid state", http.StatusBadRequest)
 		return
 	}
@@ -233,6 +352,9 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request, logger *log.Lo
 	data.Set("client_secret", entry.Secret)
 	data.Set("redirect_uri", getCallbackURL())
 	data.Set("code", code)
+	if pending.Verifier != "" {
+		data.Set("code_verifier", pending.Verifier)
+	}
 
 	resp, err := http.Post(tokenURL, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
 	if err != nil {
@@ -257,8 +379,27 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request, logger *log.Lo
 		return
 	}
 
+	// In session mode the token stays here and the page only hands over the
+	// handle that names this login in the session
+	if SessionMode() {
+		handle, err := storeSessionToken(w, r, instance, accessToken)
+		if err != nil {
+			logger.Println("failed to store session:", err)
+			http.Error(w, "failed to store session", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		renderCallback(w, map[string]string{"type": "oauth_session", "account": handle, "instance": instance}, logger)
+		return
+	}
+
 	// Return HTML page that posts token back to the opener window
-	html := fmt.Sprintf(`<!DOCTYPE html>
+	renderCallback(w, map[string]string{"type": "oauth_token", "access_token": accessToken}, logger)
+}
+
+// callbackPage posts its message to the window that started the login and
+// closes; html/template escapes the message for the script it sits in
+var callbackPage = template.Must(template.New("callback").Parse(`<!DOCTYPE html>
 <html>
 <head>
     <title>Authentication Success</title>
@@ -266,16 +407,47 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request, logger *log.Lo
 <body style="background: #20202c; color: #ffffff; font-family: 'samsung-reg', sans-serif; text-align: center; padding-top: 50px;">
     <h1>Authentication Successful</h1>
     <p>Redirecting...</p>
-    <script> 
-        const token = %q;
-        const instance = %q;
+    <script>
         const channel = new BroadcastChannel('auth_channel');
-        channel.postMessage({ type: 'oauth_token', access_token: token });
+        channel.postMessage({{.}});
         setTimeout(() => window.close(), 200);
     </script>
 </body>
-</html>`, accessToken, instance)
+</html>`))
+
+// renderCallback writes callbackPage carrying msg
+func renderCallback(w http.ResponseWriter, msg map[string]string, logger *log.Logger) {
+	var page bytes.Buffer
+	if err := callbackPage.Execute(&page, msg); err != nil {
+		logger.Println("failed to render callback page:", err)
+		http.Error(w, "failed to render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(page.Bytes())
+}
 
-	w.Header().Set("Content-Type", "text/html")
-	_, _ = w.Write([]byte(html))
+// validInstanceDomain reports whether domain is a plain hostname, optionally
+// with a port, and so safe to put in URLs and pages as it is
+func validInstanceDomain(domain string) bool {
+	host, port, found := strings.Cut(domain, ":")
+	if found {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 || strconv.Itoa(n) != port {
+			return false
+		}
+	}
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for label := range strings.SplitSeq(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
 }
@@ -0,0 +1,107 @@
+package mastodon
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOauthCallbackState(t *testing.T) {
+	t.Setenv("MASTODON_SESSIONS", "")
+	var exchanges int
+	instance := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchanges++
+		if r.URL.Path != "/oauth/token" || r.FormValue("code") != "the-code" || r.FormValue("code_verifier") != "the-verifier" {
+			http.Error(w, "bad exchange", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"access_token":"the-token"}`)
+	}))
+	defer instance.Close()
+	saved := http.DefaultClient
+	http.DefaultClient = instance.Client()
+	defer func() { http.DefaultClient = saved }()
+
+	host := strings.TrimPrefix(instance.URL, "https://")
+	mastodonMu.Lock()
+	mastodonServers[host] = ServerEntry{Domain: host, ID: "client", Secret: "secret"}
+	mastodonMu.Unlock()
+	defer func() {
+		mastodonMu.Lock()
+		delete(mastodonServers, host)
+		mastodonMu.Unlock()
+	}()
+
+	pending := func(expires time.Duration) oauthState {
+		return oauthState{Instance: host, Verifier: "the-verifier", Binding: "the-binding", Expires: time.Now().Add(expires)}
+	}
+	tests := []struct {
+		name    string
+		state   oauthState
+		stored  bool
+		cookie  string
+		status  int
+		replays bool // the same state is tried a second time
+	}{
+		{"good", pending(time.Minute), true, "the-binding", http.StatusOK, true},
+		{"expired", pending(-time.Second), true, "the-binding", http.StatusBadRequest, false},
+		{"missing cookie", pending(time.Minute), true, "", http.StatusBadRequest, false},
+		{"mismatched cookie", pending(time.Minute), true, "other-binding", http.StatusBadRequest, true},
+		{"unknown state", pending(time.Minute), false, "the-binding", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		exchanges = 0
+		state, err := genState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.stored {
+			oauthStatesMu.Lock()
+			oauthStates[state] = tt.state
+			oauthStatesMu.Unlock()
+		}
+		callback := func(cookie string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/callback?code=the-code&state="+state, nil)
+			if cookie != "" {
+				r.AddCookie(&http.Cookie{Name: oauthCookie, Value: cookie})
+			}
+			rec := httptest.NewRecorder()
+			OauthCallbackHandler(rec, r, log.New(io.Discard, "", 0))
+			return rec
+		}
+
+		rec := callback(tt.cookie)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+			continue
+		}
+		if tt.status == http.StatusOK {
+			if exchanges != 1 || !strings.Contains(rec.Body.String(), `"access_token":"the-token"`) {
+				t.Errorf("%s: %d exchanges, page:\n%s", tt.name, exchanges, rec.Body)
+			}
+		} else if exchanges != 0 {
+			t.Errorf("%s: rejected state still reached the instance", tt.name)
+		}
+		if cleared := rec.Result().Cookies(); len(cleared) != 1 || cleared[0].Name != oauthCookie || cleared[0].MaxAge >= 0 {
+			t.Errorf("%s: binding cookie not cleared: %v", tt.name, cleared)
+		}
+
+		// a state is used up by its first callback, whatever the outcome
+		if tt.replays {
+			if rec := callback("the-binding"); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: replayed state got status %d", tt.name, rec.Code)
+			}
+		}
+		oauthStatesMu.RLock()
+		_, left := oauthStates[state]
+		oauthStatesMu.RUnlock()
+		if left {
+			t.Errorf("%s: state still stored after its callback", tt.name)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package mastodon
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In session mode (MASTODON_SESSIONS=true) access tokens never reach the
+// browser: the callback seals them into a server-side session named by an
+// HttpOnly cookie, and nebulink.js talks to the instance through
+// /api/mastodon/<account>/..., which adds the token on the way out.
+
+const sessionCookie = "nebulink_session"
+
+// maxProxyBody caps what the proxy forwards to an instance
+const maxProxyBody = 1 << 20
+
+// proxyRoutes are the instance API calls nebulink.js makes, a * in a path
+// standing for one segment such as an ID; nothing else is proxied
+var proxyRoutes = []struct{ method, path string }{
+	{http.MethodGet, "/api/v1/timelines/home"},
+	{http.MethodGet, "/api/v1/timelines/public"},
+	{http.MethodGet, "/api/v1/timelines/tag/*"},
+	{http.MethodGet, "/api/v1/trends/statuses"},
+	{http.MethodGet, "/api/v2/search"},
+	{http.MethodGet, "/api/v1/followed_tags"},
+	{http.MethodGet, "/api/v1/accounts/verify_credentials"},
+	{http.MethodGet, "/api/v1/accounts/*/statuses"},
+	{http.MethodGet, "/api/v1/accounts/*/following"},
+	{http.MethodGet, "/api/v1/statuses/*/context"},
+	{http.MethodPost, "/api/v1/statuses/*/translate"},
+	{http.MethodPost, "/api/v1/statuses/*/favourite"},
+	{http.MethodPost, "/api/v1/statuses/*/unfavourite"},
+	{http.MethodGet, "/api/v2/filters"},
+	{http.MethodPost, "/api/v2/filters"},
+	{http.MethodDelete, "/api/v2/filters/*"},
+	{http.MethodPost, "/api/v2/filters/*/keywords"},
+}
+
+// sessionAccount is one Mastodon login held by a session
+type sessionAccount struct {
+	Instance string `json:"instance"`
+	Token    []byte `json:"token"` // sealed with the session key
+}
+
+type session struct {
+	Accounts map[string]sessionAccount `json:"accounts"` // account handle -> login
+	Expires  time.Time                 `json:"expires"`
+}
+
+var (
+	// sessions is keyed by the SHA-256 of the cookie value, so neither
+	// memory nor MASTODON_SESSION_PATH holds anything a browser could replay
+	sessions   = make(map[string]*session)
+	sessionsMu sync.Mutex
+	sessionKey cipher.AEAD
+	sessionTTL = 30 * 24 * time.Hour
+	proxy      = &http.Client{Timeout: 15 * time.Second}
+)
+
+// SessionMode reports whether access tokens are kept in server-side sessions
+func SessionMode() bool {
+	return os.Getenv("MASTODON_SESSIONS") == "true"
+}
+
+// InitSessions sets up the session key from MASTODON_SESSION_KEY (32 bytes,
+// hex or base64; random per process if unset) and loads the sessions saved
+// at MASTODON_SESSION_PATH, if any
+func InitSessions(logger *log.Logger) error {
+	key, err := parseSessionKey(os.Getenv("MASTODON_SESSION_KEY"))
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		logger.Println("Warning: MASTODON_SESSION_KEY not set, sessions will not survive a restart")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if sessionKey, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("MASTODON_SESSION_TTL")); err == nil && ttl > 0 {
+		sessionTTL = ttl
+	}
+
+	data, err := os.ReadFile(os.Getenv("MASTODON_SESSION_PATH"))
+	if err != nil {
+		if os.IsNotExist(err) || os.Getenv("MASTODON_SESSION_PATH") == "" {
+			return nil
+		}
+		return err
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return json.Unmarshal(data, &sessions)
+}
+
+// parseSessionKey decodes a 32-byte key given as hex or base64
+func parseSessionKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("MASTODON_SESSION_KEY must be 32 bytes, hex or base64 encoded")
+	}
+	return key, nil
+}
+
+// saveSessions writes the live sessions to MASTODON_SESSION_PATH, if set.
+// Callers must hold sessionsMu.
+func saveSessions() error {
+	p := os.Getenv("MASTODON_SESSION_PATH")
+	if p == "" {
+		return nil
+	}
+	now := time.Now()
+	for id, s := range sessions {
+		if now.After(s.Expires) {
+			delete(sessions, id)
+		}
+	}
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0600)
+}
+
+// secureCookies reports whether cookies should be marked Secure, which is
+// everywhere but plain-HTTP development
+func secureCookies() bool {
+	return os.Getenv("ENV") != "development" || os.Getenv("USE_HTTPS") == "true"
+}
+
+// sessionID hashes a cookie value into the key sessions is stored under
+func sessionID(cookie string) string {
+	sum := sha256.Sum256([]byte(cookie))
+	return hex.EncodeToString(sum[:])
+}
+
+// currentSession returns the live session named by r's cookie, if any.
+// Callers must hold sessionsMu.
+func currentSession(r *http.Request) *session {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	s := sessions[sessionID(c.Value)]
+	if s == nil || time.Now().After(s.Expires) {
+		return nil
+	}
+	return s
+}
+
+// storeSessionToken seals token into the caller's session, starting one
+// (and setting its cookie) if needed, and returns the handle the browser
+// uses to name this login
+func storeSessionToken(w http.ResponseWriter, r *http.Request, instance, token string) (string, error) {
+	handle, err := genState()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, sessionKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	// the handle is bound in as additional data so a sealed token cannot be
+	// moved to another account entry
+	sealed := sessionKey.Seal(nonce, nonce, []byte(token), []byte(handle))
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s := currentSession(r)
+	if s == nil {
+		cookie, err := genState()
+		if err != nil {
+			return "", err
+		}
+		s = &session{Accounts: make(map[string]sessionAccount)}
+		sessions[sessionID(cookie)] = s
+		http.SetCookie(w, &http.Cookie{
+			Name:  sessionCookie,
+			Value: cookie,
+			Path:  "/",
+			// Lax rather than Strict: the OAuth callback arrives as a
+			// cross-site navigation and must see the session it adds to
+			SameSite: http.SameSiteLaxMode,
+			HttpOnly: true,
+			Secure:   secureCookies(),
+			MaxAge:   int(sessionTTL.Seconds()),
+		})
+	}
+	s.Expires = time.Now().Add(sessionTTL)
+	s.Accounts[handle] = sessionAccount{Instance: instance, Token: sealed}
+	return handle, saveSessions()
+}
+
+// sessionToken unseals the access token of account handle in r's session
+func sessionToken(r *http.Request, handle string) (instance, token string, ok bool) {
+	sessionsMu.Lock()
+	s := currentSession(r)
+	var acct sessionAccount
+	if s != nil {
+		acct, ok = s.Accounts[handle]
+	}
+	sessionsMu.Unlock()
+	if !ok || len(acct.Token) < sessionKey.NonceSize() {
+		return "", "", false
+	}
+	nonce, sealed := acct.Token[:sessionKey.NonceSize()], acct.Token[sessionKey.NonceSize():]
+	plain, err := sessionKey.Open(nil, nonce, sealed, []byte(handle))
+	if err != nil {
+		return "", "", false
+	}
+	return acct.Instance, string(plain), true
+}
+
+// forgetSessionAccount drops account handle from r's session
+func forgetSessionAccount(r *http.Request, handle string) error {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s := currentSession(r)
+	if s == nil {
+		return nil
+	}
+	delete(s.Accounts, handle)
+	return saveSessions()
+}
+
+// sameOrigin reports whether r was sent by one of our own pages
+func sameOrigin(r *http.Request) bool {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && origin.Host == r.Host
+}
+
+// proxyAllowed reports whether method p is one of the instance calls the
+// proxy serves; HEAD goes wherever GET does
+func proxyAllowed(method, p string) bool {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	segments := strings.Split(p, "/")
+	for _, route := range proxyRoutes {
+		if route.method == method && matchRoute(strings.Split(route.path, "/"), segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRoute reports whether the segments of a path match those of a
+// route, where * matches any one non-empty segment
+func matchRoute(route, segments []string) bool {
+	if len(route) != len(segments) {
+		return false
+	}
+	for i, want := range route {
+		if segments[i] != want && (want != "*" || segments[i] == "") {
+			return false
+		}
+	}
+	return true
+}
+
+// SessionProxyHandler forwards /api/mastodon/<account>/<instance path> to
+// the account's instance with its access token attached
+func SessionProxyHandler(w http.ResponseWriter, r *http.Request, logger *log.Logger) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/mastodon/")
+	handle, apiPath, _ := strings.Cut(rest, "/")
+	apiPath = "/" + apiPath
+	if path.Clean(apiPath) != apiPath || !proxyAllowed(r.Method, apiPath) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	// the cookie rides along on cross-site requests too, so anything that
+	// changes state has to come from our own pages
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	instance, token, ok := sessionToken(r, handle)
+	if !ok {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	target := "https://" + instance + apiPath
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target, http.MaxBytesReader(w, r.Body, maxProxyBody))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	for _, h := range []string{"Content-Type", "Accept", "Accept-Language", "Idempotency-Key"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	resp, err := proxy.Do(req)
+	if err != nil {
+		logger.Println("mastodon proxy:", err)
+		http.Error(w, "instance unreachable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range []string{"Content-Type", "Link", "X-RateLimit-Remaining", "X-RateLimit-Reset"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
@@ -0,0 +1,253 @@
+package mastodon
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testSessions sets up a fixed session key and an empty session table
+func testSessions(t *testing.T) {
+	t.Helper()
+	t.Setenv("MASTODON_SESSION_KEY", strings.Repeat("ab", 32))
+	t.Setenv("MASTODON_SESSION_PATH", "")
+	if err := InitSessions(log.New(io.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	sessionsMu.Lock()
+	sessions = make(map[string]*session)
+	sessionsMu.Unlock()
+}
+
+// login stores token for instance in a new session and returns its cookie
+// and the account handle
+func login(t *testing.T, instance, token string) (*http.Cookie, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handle, err := storeSessionToken(rec, httptest.NewRequest(http.MethodGet, "/callback", nil), instance, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Fatalf("login set cookies %v", cookies)
+	}
+	return cookies[0], handle
+}
+
+func TestSessionTokenSealing(t *testing.T) {
+	testSessions(t)
+	cookie, handle := login(t, "example.social", "secret-token")
+	other, _ := login(t, "example.social", "other-token")
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	instance, token, ok := sessionToken(r, handle)
+	if !ok || instance != "example.social" || token != "secret-token" {
+		t.Fatalf("sessionToken = %q, %q, %v", instance, token, ok)
+	}
+
+	sessionsMu.Lock()
+	s := sessions[sessionID(cookie.Value)]
+	acct := s.Accounts[handle]
+	sessionsMu.Unlock()
+	if bytes.Contains(acct.Token, []byte("secret-token")) {
+		t.Fatal("session holds the token in the clear")
+	}
+
+	if _, _, ok := sessionToken(httptest.NewRequest(http.MethodGet, "/", nil), handle); ok {
+		t.Error("token handed out without a session cookie")
+	}
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(other)
+	if _, _, ok := sessionToken(r, handle); ok {
+		t.Error("token handed out to another session")
+	}
+
+	// a sealed token is bound to its handle and to every byte of itself
+	sessionsMu.Lock()
+	s.Accounts["moved"] = acct
+	tampered := bytes.Clone(acct.Token)
+	tampered[len(tampered)-1] ^= 1
+	s.Accounts["tampered"] = sessionAccount{Instance: acct.Instance, Token: tampered}
+	s.Accounts["short"] = sessionAccount{Instance: acct.Instance, Token: acct.Token[:4]}
+	sessionsMu.Unlock()
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	for _, h := range []string{"moved", "tampered", "short"} {
+		if _, _, ok := sessionToken(r, h); ok {
+			t.Errorf("%s token unsealed", h)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://nebulink.example", true},
+		{"http://nebulink.example", true},
+		{"https://evil.example", false},
+		{"https://nebulink.example.evil.example", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "https://nebulink.example/api/mastodon/x/api/v2/filters", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := sameOrigin(r); got != tt.want {
+			t.Errorf("Origin %q: sameOrigin = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestProxyAllowed(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{http.MethodGet, "/api/v1/timelines/home", true},
+		{http.MethodHead, "/api/v1/timelines/home", true},
+		{http.MethodGet, "/api/v1/timelines/tag/go", true},
+		{http.MethodGet, "/api/v1/accounts/verify_credentials", true},
+		{http.MethodGet, "/api/v1/accounts/123/statuses", true},
+		{http.MethodGet, "/api/v1/accounts/123/following", true},
+		{http.MethodPost, "/api/v1/statuses/123/favourite", true},
+		{http.MethodDelete, "/api/v2/filters/7", true},
+		{http.MethodPost, "/api/v2/filters/7/keywords", true},
+		{http.MethodGet, "/api/v1/accounts/", false},
+		{http.MethodGet, "/api/v1/accounts/123", false},
+		{http.MethodPost, "/api/v1/accounts/123/follow", false},
+		{http.MethodPatch, "/api/v1/accounts/update_credentials", false},
+		{http.MethodGet, "/api/v1/accounts//statuses", false},
+		{http.MethodPost, "/api/v1/timelines/home", false},
+		{http.MethodDelete, "/api/v1/statuses/123", false},
+		{http.MethodPost, "/api/v1/statuses", false},
+		{http.MethodGet, "/api/v1/timelines/tag/go/extra", false},
+		{http.MethodGet, "/api/v1/admin/accounts", false},
+	}
+	for _, tt := range tests {
+		if got := proxyAllowed(tt.method, tt.path); got != tt.want {
+			t.Errorf("%s %s: proxyAllowed = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSessionProxyHandler(t *testing.T) {
+	testSessions(t)
+	var got *http.Request
+	instance := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `[]`)
+	}))
+	defer instance.Close()
+	saved := proxy
+	proxy = instance.Client()
+	defer func() { proxy = saved }()
+
+	host := strings.TrimPrefix(instance.URL, "https://")
+	cookie, handle := login(t, host, "secret-token")
+
+	tests := []struct {
+		name, method, path, origin string
+		status                     int
+	}{
+		{"allowed read", http.MethodGet, "/api/v1/accounts/1/statuses?limit=5", "", http.StatusOK},
+		{"allowed write", http.MethodPost, "/api/v1/statuses/1/favourite", "https://nebulink.example", http.StatusOK},
+		{"cross-origin write", http.MethodPost, "/api/v1/statuses/1/favourite", "https://evil.example", http.StatusForbidden},
+		{"write without origin", http.MethodPost, "/api/v1/statuses/1/favourite", "", http.StatusForbidden},
+		{"other account endpoint", http.MethodGet, "/api/v1/accounts/1", "", http.StatusNotFound},
+		{"unclean path", http.MethodGet, "/api/v1/timelines/tag/../../accounts/1", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		got = nil
+		r := httptest.NewRequest(tt.method, "https://nebulink.example/api/mastodon/"+handle+tt.path, nil)
+		r.AddCookie(cookie)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		rec := httptest.NewRecorder()
+		SessionProxyHandler(rec, r, log.New(io.Discard, "", 0))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			if got != nil {
+				t.Errorf("%s: refused request still reached the instance", tt.name)
+			}
+			continue
+		}
+		want, _, _ := strings.Cut(tt.path, "?")
+		if got == nil || got.URL.Path != want || got.Header.Get("Authorization") != "Bearer secret-token" {
+			t.Errorf("%s: instance saw %v", tt.name, got)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/mastodon/"+handle+"/api/v1/timelines/home", nil)
+	rec := httptest.NewRecorder()
+	SessionProxyHandler(rec, r, log.New(io.Discard, "", 0))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a session: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestValidInstanceDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"mastodon.social", true},
+		{"Example-1.social", true},
+		{"localhost:3000", true},
+		{"", false},
+		{"-bad.social", false},
+		{"bad-.social", false},
+		{"two..dots", false},
+		{"example.social:", false},
+		{"example.social:0", false},
+		{"example.social:99999", false},
+		{"example.social/path", false},
+		{"user@example.social", false},
+		{`example.social"</script>`, false},
+		{"exa mple.social", false},
+		{strings.Repeat("a", 64) + ".social", false},
+	}
+	for _, tt := range tests {
+		if got := validInstanceDomain(tt.domain); got != tt.want {
+			t.Errorf("validInstanceDomain(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestAuthRejectsInvalidInstance(t *testing.T) {
+	form := url.Values{"instance_domain": {`x"</script><script>alert(1)//`}}
+	r := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	AuthNebuLinkHandler(rec, r, log.New(io.Discard, "", 0))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCallbackPageEscapes(t *testing.T) {
+	rec := httptest.NewRecorder()
+	renderCallback(rec, map[string]string{"type": "oauth_session", "instance": `x'"</script><script>alert(1)</script>`}, log.New(io.Discard, "", 0))
+	page := rec.Body.String()
+	if rec.Code != http.StatusOK || strings.Count(page, "<script>") != 1 || strings.Contains(page, "alert(1)</script>") {
+		t.Fatalf("callback page not escaped:\n%s", page)
+	}
+	if !strings.Contains(page, `"type":"oauth_session"`) {
+		t.Errorf("callback page lost its message:\n%s", page)
+	}
+}
@@ -1,18 +1,95 @@
 package middleware
 
 import (
+	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 )
 
+// trustedProxies are the networks whose X-Forwarded-For headers GetClientIP
+// believes; it is set once at startup by SetTrustedProxies
+var trustedProxies []*net.IPNet
+
+var (
+	proxyLogger *log.Logger
+	// warnUntrusted makes sure an untrusted X-Forwarded-For is reported once
+	warnUntrusted sync.Once
+)
+
+// SetTrustedProxies parses a comma-separated list of IPs and CIDRs, such as
+// "127.0.0.1,10.0.0.0/8", naming the reverse proxies in front of the server.
+// An empty list trusts none. The first X-Forwarded-For seen while none are
+// trusted is reported to logger, since every client behind that proxy then
+// shares its address.
+func SetTrustedProxies(list string, logger *log.Logger) error {
+	proxyLogger = logger
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("trusted proxy %q: %w", entry, err)
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+// TrustedProxy reports whether ip belongs to one of the trusted proxies
+func TrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetClientIP returns the address the request came from. X-Forwarded-For is
+// only believed when the connection comes from a trusted proxy, and then the
+// client is the nearest address in it that is not a trusted proxy itself.
 func GetClientIP(r *http.Request) string {
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip != "" {
-		ips := strings.Split(ip, ",")
-		return strings.TrimSpace(ips[0])
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !TrustedProxy(ip) {
+		if len(trustedProxies) == 0 && proxyLogger != nil && r.Header.Get("X-Forwarded-For") != "" {
+			warnUntrusted.Do(func() {
+				proxyLogger.Printf("X-Forwarded-For from %s ignored: set TRUSTED_PROXIES to the reverse proxy's address, or every client looks like the proxy", ip)
+			})
+		}
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !TrustedProxy(hop) {
+			break
+		}
 	}
-	ip, _, _ = net.SplitHostPort(r.RemoteAddr)
 	return ip
 }
 
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies string
+		remote  string
+		xff     string
+		want    string
+	}{
+		{"no proxy trusted", "", "198.51.100.7:443", "203.0.113.1", "198.51.100.7"},
+		{"untrusted sender", "10.0.0.0/8", "198.51.100.7:443", "203.0.113.1", "198.51.100.7"},
+		{"trusted proxy", "10.0.0.1", "10.0.0.1:80", "203.0.113.1", "203.0.113.1"},
+		{"spoofed hop before the client", "10.0.0.0/8", "10.0.0.1:80", "192.0.2.66, 203.0.113.1, 10.0.0.2", "203.0.113.1"},
+		{"trusted proxy without header", "10.0.0.1", "10.0.0.1:80", "", "10.0.0.1"},
+		{"IPv6 proxy", "::1", "[::1]:80", "2001:db8::7", "2001:db8::7"},
+	}
+	for _, tt := range tests {
+		if err := SetTrustedProxies(tt.proxies, nil); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := GetClientIP(r); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if err := SetTrustedProxies("10.0.0.0/33", nil); err == nil {
+		t.Error("accepted a bad CIDR")
+	}
+	SetTrustedProxies("", nil)
+}
+
+func TestUntrustedForwardedForWarnsOnce(t *testing.T) {
+	var buf bytes.Buffer
+	if err := SetTrustedProxies("", log.New(&buf, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetTrustedProxies("", nil) })
+	for range 3 {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Forwarded-For", "203.0.113.1")
+		GetClientIP(r)
+	}
+	if n := strings.Count(buf.String(), "TRUSTED_PROXIES"); n != 1 {
+		t.Fatalf("warned %d times: %q", n, buf.String())
+	}
+}
@@ -0,0 +1,81 @@
+package signaling
+
+import (
+	"sync"
+	"time"
+)
+
+// Broker carries room traffic between Hubs running in different processes,
+// so a phone that lands on one replica can pair with a watch on another.
+type Broker interface {
+	// Publish sends env to every subscriber, including the publishing Hub
+	Publish(env Envelope) error
+	// Subscribe registers fn to receive every published Envelope
+	Subscribe(fn func(Envelope))
+	Close() error
+}
+
+// Envelope kinds
+const (
+	// KindSignal relays a SignalMessage to the origin's room members elsewhere
+	KindSignal = "signal"
+	// KindPresence relays a presence event (Msg.Type) about Msg's subject
+	KindPresence = "presence"
+	// KindAnnounce lists the members Origin holds for room Code and when they
+	// joined; it is sent periodically and whenever someone joins that room on
+	// another instance, with the room's state document in that case
+	KindAnnounce = "announce"
+	// KindKick asks whichever instance holds Msg's subject to remove it on
+	// behalf of the room's host
+	KindKick = "kick"
+	// KindState relays an EventStateChanged so every instance's copy of the
+	// room's document converges on the newest version of each key
+	KindState = "state"
+)
+
+// Envelope is what Hubs exchange through a Broker
+type Envelope struct {
+	Origin string        `json:"origin"`
+	Kind   string        `json:"kind"`
+	Code   string        `json:"code"`
+	Msg    SignalMessage `json:"msg"`
+	Names  []string      `json:"names,omitempty"`
+	// Joined is when each member named by a peer-joined event or an
+	// announce joined, which decides who hosts the room
+	Joined map[string]time.Time `json:"joined,omitempty"`
+	// State is the room's state document as the origin has it, sent along
+	// with peer-joined events and the announces answering them
+	State *Document `json:"state,omitempty"`
+}
+
+// LocalBroker delivers envelopes synchronously to Hubs in the same process.
+// It is the default for a single instance, where the only subscriber is the
+// sender itself.
+type LocalBroker struct {
+	mu   sync.RWMutex
+	subs []func(Envelope)
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+func (b *LocalBroker) Publish(env Envelope) error {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	for _, fn := range subs {
+		fn(env)
+	}
+	return nil
+}
+
+func (b *LocalBroker) Subscribe(fn func(Envelope)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, fn)
+}
+
+func (b *LocalBroker) Close() error {
+	return nil
+}
@@ -0,0 +1,162 @@
+package signaling
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits bounds how much signaling data the server buffers on behalf of
+// clients that are slow, gone, or misbehaving
+type Limits struct {
+	MaxMessageBytes int  // largest accepted SignalMessage
+	MaxQueueLen     int  // messages waiting per peer
+	MaxPeerBytes    int  // bytes waiting per peer
+	MaxRoomBytes    int  // bytes waiting across a whole room
+	MaxStateBytes   int  // keys and values in a room's state document
+	DropOldest      bool // discard old messages to make space instead of rejecting new ones
+
+	// RelayBytesPerSec and RelayBurstBytes cap the relay frames a room's
+	// members send through this instance
+	RelayBytesPerSec int
+	RelayBurstBytes  int
+}
+
+// ICEConfig lists the STUN and TURN servers handed to clients
+type ICEConfig struct {
+	// LocalSTUNPort is the UDP port of the embedded STUN responder, or 0
+	LocalSTUNPort int
+	STUNURLs      []string
+	TURNURLs      []string
+	// TURNSecret is the static-auth-secret shared with the TURN server;
+	// without it no TURN servers are offered
+	TURNSecret string
+	// TURNTTL is how long issued TURN credentials stay valid
+	TURNTTL time.Duration
+}
+
+// DropConfig bounds the files members leave for each other through /webrtc/drops
+type DropConfig struct {
+	Dir          string // where uploads are kept until downloaded
+	MaxBytes     int64  // largest file
+	MaxRoomBytes int64  // all files waiting in one room
+	TTL          time.Duration
+}
+
+// Config tunes a Hub
+type Config struct {
+	// PeerTimeout is how long a peer may go unseen before the janitor evicts it
+	PeerTimeout time.Duration
+	// ReplayWindow is how long a delivered but unacknowledged message is
+	// kept for redelivery before it is dropped anyway
+	ReplayWindow time.Duration
+	// HoldTTL is how long a message for a member who has not joined yet is
+	// kept waiting for them
+	HoldTTL time.Duration
+	// PairingTTL is how long a server-issued pairing code accepts new members
+	PairingTTL time.Duration
+	// StateTTL is how long a room's state document outlives its last member
+	StateTTL time.Duration
+	// PairingBaseURL is the page pairing links and QR codes point at; empty
+	// means the NebuLink page on whichever host the request came in on
+	PairingBaseURL string
+	// MaxPeers caps how many members a room holds across all instances
+	MaxPeers int
+	// NameConflict is what a join does with a taken name unless it asks otherwise
+	NameConflict NameConflict
+	// DeviceSecret signs device challenges; instances sharing a Broker need
+	// the same one. Empty means a random secret per process.
+	DeviceSecret string
+	ICE          ICEConfig
+	Drop         DropConfig
+	Limits       Limits
+}
+
+// ConfigFromEnv reads the WEBRTC_* environment variables documented in the README
+func ConfigFromEnv() Config {
+	nameConflict := ConflictReject
+	if os.Getenv("WEBRTC_NAME_CONFLICT") == string(ConflictSuffix) {
+		nameConflict = ConflictSuffix
+	}
+	return Config{
+		PeerTimeout:    durationEnv("WEBRTC_PEER_TIMEOUT", 60*time.Second),
+		ReplayWindow:   durationEnv("WEBRTC_REPLAY_WINDOW", 2*time.Minute),
+		HoldTTL:        durationEnv("WEBRTC_HOLD_TTL", time.Minute),
+		PairingTTL:     durationEnv("WEBRTC_PAIRING_TTL", 5*time.Minute),
+		StateTTL:       durationEnv("WEBRTC_STATE_TTL", 24*time.Hour),
+		PairingBaseURL: os.Getenv("WEBRTC_PAIRING_URL"),
+		MaxPeers:       intEnv("WEBRTC_MAX_PEERS", 8),
+		NameConflict:   nameConflict,
+		DeviceSecret:   os.Getenv("WEBRTC_DEVICE_SECRET"),
+		ICE: ICEConfig{
+			STUNURLs:   listEnv("WEBRTC_STUN_URLS", "stun:stun.l.google.com:19302"),
+			TURNURLs:   listEnv("WEBRTC_TURN_URLS", ""),
+			TURNSecret: os.Getenv("WEBRTC_TURN_SECRET"),
+			TURNTTL:    durationEnv("WEBRTC_TURN_TTL", time.Hour),
+		},
+		Drop: DropConfig{
+			Dir:          envOr("WEBRTC_DROP_DIR", filepath.Join(os.TempDir(), "nebulink-drops")),
+			MaxBytes:     int64(intEnv("WEBRTC_DROP_MAX_BYTES", 25<<20)),
+			MaxRoomBytes: int64(intEnv("WEBRTC_DROP_ROOM_BYTES", 100<<20)),
+			TTL:          durationEnv("WEBRTC_DROP_TTL", 10*time.Minute),
+		},
+		Limits: Limits{
+			MaxMessageBytes: intEnv("WEBRTC_MAX_MESSAGE_BYTES", 64<<10),
+			MaxQueueLen:     intEnv("WEBRTC_MAX_QUEUE_LEN", 256),
+			MaxPeerBytes:    intEnv("WEBRTC_MAX_PEER_BYTES", 1<<20),
+			MaxRoomBytes:    intEnv("WEBRTC_MAX_ROOM_BYTES", 4<<20),
+			MaxStateBytes:   intEnv("WEBRTC_MAX_STATE_BYTES", 64<<10),
+			DropOldest:      os.Getenv("WEBRTC_QUEUE_POLICY") == "drop-oldest",
+
+			RelayBytesPerSec: intEnv("WEBRTC_RELAY_RATE", 64<<10),
+			RelayBurstBytes:  intEnv("WEBRTC_RELAY_BURST", 256<<10),
+		},
+	}
+}
+
+// envOr reads a string from the environment
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// durationEnv reads a time.Duration such as "90s" from the environment
+func durationEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
+// listEnv reads a comma-separated list from the environment
+func listEnv(key, def string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		v = def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// intEnv reads a positive integer from the environment
+func intEnv(key string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,326 @@
+package signaling
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"galacticApps/middleware"
+)
+
+// challengeTTL is how long a device has to sign a challenge
+const challengeTTL = 2 * time.Minute
+
+// deviceRoomPrefix marks the rooms ConnectDevice opens for a pair of devices;
+// such codes cannot be joined or created any other way
+const deviceRoomPrefix = "device:"
+
+// Device is a client that registered an Ed25519 identity key while in a
+// pairing room, so it can later reach the devices it met there without a code
+type Device struct {
+	// ID is derived from the public key, so a key can only register once
+	ID         string            `json:"id"`
+	PublicKey  ed25519.PublicKey `json:"publicKey"`
+	Name       string            `json:"name"`
+	Registered time.Time         `json:"registered"`
+}
+
+// deviceID is the base64url encoding of the first 16 bytes of the key's SHA-256
+func deviceID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// deviceRoomCode is the room two paired devices meet in; it is the same
+// whichever of them connects first
+func deviceRoomCode(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	sum := sha256.Sum256([]byte(a + "\n" + b))
+	return deviceRoomPrefix + hex.EncodeToString(sum[:16])
+}
+
+// deviceMessage is what a device signs to prove it holds its key: the
+// action, a challenge from Challenge, and what the action applies to (the
+// room code when registering, the other device's ID otherwise)
+func deviceMessage(action, challenge, subject string) []byte {
+	return []byte("nebulink-device\n" + action + "\n" + challenge + "\n" + subject)
+}
+
+// Challenge issues a nonce for a device to sign. Challenges are stateless
+// (an HMAC under the device secret, so any instance sharing it accepts
+// them) and are good for one use within challengeTTL.
+func (h *Hub) Challenge() (string, time.Time, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(challengeTTL).Truncate(time.Second)
+	body := base64.RawURLEncoding.EncodeToString(nonce) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return body + "." + h.challengeMAC(body), expires, nil
+}
+
+// challengeMAC authenticates the nonce and expiry of a challenge
+func (h *Hub) challengeMAC(body string) string {
+	mac := hmac.New(sha256.New, h.deviceKey)
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyDevice checks that d signed action on subject over a live challenge
+// this instance has not seen used yet, then uses it up
+func (h *Hub) verifyDevice(d *Device, action, challenge, subject string, sig []byte) error {
+	body, mac, ok := cutLast(challenge, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(h.challengeMAC(body))) {
+		return ErrBadChallenge
+	}
+	_, exp, _ := cutLast(body, ".")
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	expires := time.Unix(unix, 0)
+	now := time.Now()
+	if err != nil || now.After(expires) {
+		return ErrBadChallenge
+	}
+	if len(d.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(d.PublicKey, deviceMessage(action, challenge, subject), sig) {
+		return ErrBadSignature
+	}
+
+	h.challengeMu.Lock()
+	defer h.challengeMu.Unlock()
+	if _, seen := h.usedChallenges[challenge]; seen {
+		return ErrBadChallenge
+	}
+	for c, exp := range h.usedChallenges {
+		if now.After(exp) {
+			delete(h.usedChallenges, c)
+		}
+	}
+	h.usedChallenges[challenge] = expires
+	return nil
+}
+
+// cutLast splits s around the last sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// RegisterDevice records pub as the identity of the peer owning token and
+// pairs it with every other registered device in the room, which are told
+// with EventDevicePaired. The signature covers the room code. name defaults
+// to the peer's name. Only rooms opened through Pair qualify: a code anyone
+// could guess or share must not hand out lasting access to a device.
+func (h *Hub) RegisterDevice(token string, pub ed25519.PublicKey, name, challenge string, sig []byte) (*Device, []*Device, error) {
+	room, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	if room.Expires.IsZero() {
+		return nil, nil, ErrNotPairingRoom
+	}
+	if name == "" {
+		name = p.Name
+	}
+	d := &Device{ID: deviceID(pub), PublicKey: pub, Name: name, Registered: time.Now()}
+	if err := h.verifyDevice(d, "register", challenge, room.Code, sig); err != nil {
+		return nil, nil, err
+	}
+	if err := h.store.SaveDevice(d); err != nil {
+		return nil, nil, err
+	}
+	p.Device = d.ID
+
+	paired := []*Device{}
+	for _, other := range room.Peers {
+		if other.Device == "" || other.Device == d.ID {
+			continue
+		}
+		od, err := h.store.LoadDevice(other.Device)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := h.store.SavePairing(d.ID, od.ID); err != nil {
+			return nil, nil, err
+		}
+		paired = append(paired, od)
+		other.notify(pairedEvent(room.Code, p.Name, d), h.cfg.Limits)
+		h.wake(other.Token)
+	}
+	return d, paired, h.store.SaveRoom(room)
+}
+
+// pairedEvent is the EventDevicePaired telling a member that the peer
+// called name, registered as d, is now paired with it
+func pairedEvent(code, name string, d *Device) SignalMessage {
+	msg := SignalMessage{Code: code, Type: EventDevicePaired}
+	msg.Data, _ = json.Marshal(map[string]any{"name": name, "device": d})
+	return msg
+}
+
+// ConnectDevice opens (or rejoins) the room device id shares with the
+// device it is paired with, peer, once id has signed a challenge naming
+// peer. Each device is a member under its ID; connecting again replaces a
+// stale session of the same device on this instance.
+func (h *Hub) ConnectDevice(id, peer, challenge string, sig []byte, ip string) (*Membership, error) {
+	d, err := h.device(id, peer, "connect", challenge, sig)
+	if err != nil {
+		return nil, err
+	}
+	token, err := genToken()
+	if err != nil {
+		return nil, err
+	}
+
+	defer h.flush()
+	code := deviceRoomCode(d.ID, peer)
+	defer h.rooms.lock(code)()
+	room, err := h.loadRoom(code, true)
+	if err != nil {
+		return nil, err
+	}
+	return h.admit(room, d.ID, token, JoinOptions{IP: ip, OnConflict: conflictReplace, device: d.ID})
+}
+
+// Unpair forgets the pairing of device id with peer once id has signed a
+// challenge naming peer; either device may do it
+func (h *Hub) Unpair(id, peer, challenge string, sig []byte) error {
+	if _, err := h.device(id, peer, "unpair", challenge, sig); err != nil {
+		return err
+	}
+	return h.store.DeletePairing(id, peer)
+}
+
+// device loads device id and checks it signed action for its pairing with peer
+func (h *Hub) device(id, peer, action, challenge string, sig []byte) (*Device, error) {
+	d, err := h.store.LoadDevice(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrUnknownDevice
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := h.verifyDevice(d, action, challenge, peer, sig); err != nil {
+		return nil, err
+	}
+	pairings, err := h.store.Pairings(id)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(pairings, peer) {
+		return nil, ErrNotPaired
+	}
+	return d, nil
+}
+
+func (h *Hub) handleDeviceChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	challenge, expires, err := h.Challenge()
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]any{"challenge": challenge, "expires": expires})
+}
+
+func (h *Hub) handleDeviceRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// publicKey and signature are base64
+	var req struct {
+		PublicKey []byte `json:"publicKey"`
+		Name      string `json:"name,omitempty"`
+		Challenge string `json:"challenge"`
+		Signature []byte `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if len(req.PublicKey) != ed25519.PublicKeySize {
+		http.Error(w, "invalid public key", http.StatusBadRequest)
+		return
+	}
+	d, paired, err := h.RegisterDevice(peerToken(r), req.PublicKey, req.Name, req.Challenge, req.Signature)
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "device": d, "paired": paired})
+}
+
+// deviceRequest is the body of connect and unpair: the acting device, the
+// device it is paired with, and its signature over a challenge naming peer
+type deviceRequest struct {
+	Device    string `json:"device"`
+	Peer      string `json:"peer"`
+	Challenge string `json:"challenge"`
+	Signature []byte `json:"signature"`
+}
+
+// decodeDeviceRequest reads a deviceRequest, answering 400 if it is incomplete
+func decodeDeviceRequest(w http.ResponseWriter, r *http.Request) (*deviceRequest, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	var req deviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return nil, false
+	}
+	if req.Device == "" || req.Peer == "" || req.Challenge == "" {
+		http.Error(w, "missing device, peer or challenge", http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+func (h *Hub) handleDeviceConnect(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+	m, err := h.ConnectDevice(req.Device, req.Peer, req.Challenge, req.Signature, middleware.GetClientIP(r))
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	h.writeMembership(w, r, m)
+}
+
+func (h *Hub) handleDeviceUnpair(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Unpair(req.Device, req.Peer, req.Challenge, req.Signature); err != nil {
+		h.httpError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
+}
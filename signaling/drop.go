@@ -0,0 +1,437 @@
+package signaling
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDropChunk caps a single upload request; bigger files take several
+const maxDropChunk = 4 << 20
+
+// dropGrace is how long a downloaded drop stays around for the recipient to
+// resume a download that the server finished sending but the client never
+// fully received
+const dropGrace = 30 * time.Second
+
+// EventDropReady carries the Drop that is now complete and may be downloaded
+const EventDropReady = "drop-ready"
+
+// Drop is a file one member of a room leaves for the others. It is uploaded
+// in chunks, downloaded (resumably) by one recipient and deleted once that
+// download completes or its TTL runs out, whichever comes first. Drops live
+// on the local disk of the instance that received them.
+type Drop struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type,omitempty"`
+	Size    int64     `json:"size"`
+	Offset  int64     `json:"offset"` // bytes uploaded so far
+	From    string    `json:"from"`
+	To      string    `json:"to,omitempty"` // empty means any other member
+	Expires time.Time `json:"expires"`
+}
+
+// drop is a Drop as the Hub keeps it
+type drop struct {
+	Drop
+	code string
+	path string
+	// taker is the member whose download reached the end first; only its
+	// resumes are served from then on
+	taker string
+	// mu serializes the uploads and downloads of this drop, which may take a
+	// while, so they are done without holding dropMu
+	mu sync.Mutex
+}
+
+// complete reports whether every byte has been uploaded. Callers must hold
+// d.mu or dropMu.
+func (d *drop) complete() bool {
+	return d.Offset == d.Size
+}
+
+// prepareDrops makes sure the drop directory exists and clears out files
+// left by an earlier process, whose drops are gone with its memory
+func prepareDrops(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*.drop"))
+	if err != nil {
+		return err
+	}
+	for _, path := range leftovers {
+		_ = os.Remove(path)
+	}
+	return nil
+}
+
+// CreateDrop announces a file of size bytes the peer owning token is about
+// to upload, for the member called to or for anyone else in the room
+func (h *Hub) CreateDrop(token, name, typ string, size int64, to string) (Drop, error) {
+	room, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return Drop{}, err
+	}
+	code, from := room.Code, p.Name
+	exists := to == "" || room.Peers[to] != nil
+	unlock()
+	if !exists || to == from {
+		return Drop{}, ErrTargetNotFound
+	}
+	if size <= 0 || size > h.cfg.Drop.MaxBytes {
+		return Drop{}, ErrDropTooLarge
+	}
+	id, err := genToken()
+	if err != nil {
+		return Drop{}, err
+	}
+
+	d := &drop{
+		Drop: Drop{
+			ID:      id,
+			Name:    filepath.Base(name),
+			Type:    typ,
+			Size:    size,
+			From:    from,
+			To:      to,
+			Expires: time.Now().Add(h.cfg.Drop.TTL),
+		},
+		code: code,
+		path: filepath.Join(h.cfg.Drop.Dir, id+".drop"),
+	}
+	h.dropMu.Lock()
+	defer h.dropMu.Unlock()
+	used := size
+	for _, other := range h.drops {
+		if other.code == code {
+			used += other.Size
+		}
+	}
+	if used > h.cfg.Drop.MaxRoomBytes {
+		return Drop{}, ErrDropFull
+	}
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return Drop{}, err
+	}
+	f.Close()
+	h.drops[id] = d
+	return d.Drop, nil
+}
+
+// WriteDrop appends the chunk read from r to drop id, which must already
+// hold exactly offset bytes; only its uploader may write it. It returns the
+// new offset, which counts whatever reached the disk even if r failed, so
+// an interrupted upload resumes from there. A chunk over maxDropChunk, or
+// one running past the announced size, is discarded whole and leaves the
+// offset where it was. The last chunk tells the recipients with
+// EventDropReady.
+func (h *Hub) WriteDrop(token, id string, offset int64, r io.Reader) (int64, error) {
+	d, p, err := h.findDrop(token, id)
+	if err != nil {
+		return 0, err
+	}
+	if p.Name != d.From {
+		return 0, ErrNotRecipient
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if offset != d.Offset {
+		return d.Offset, ErrDropOffset
+	}
+	if d.complete() {
+		return d.Offset, nil
+	}
+	f, err := os.OpenFile(d.path, os.O_WRONLY, 0)
+	if err != nil {
+		return d.Offset, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return d.Offset, err
+	}
+	// read one byte past what this chunk may hold to notice one too big
+	limit := min(d.Size-offset, maxDropChunk)
+	n, copyErr := io.Copy(f, io.LimitReader(r, limit+1))
+	if n > limit {
+		n, copyErr = 0, ErrDropTooLarge
+	}
+	if err := f.Truncate(offset + n); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	h.dropMu.Lock()
+	d.Offset = offset + n
+	complete := d.complete()
+	h.dropMu.Unlock()
+	if copyErr != nil {
+		return d.Offset, copyErr
+	}
+	if complete {
+		return d.Offset, h.announceDrop(d)
+	}
+	return d.Offset, nil
+}
+
+// announceDrop tells the recipients of d that it can be downloaded
+func (h *Hub) announceDrop(d *drop) error {
+	defer h.rooms.lock(d.code)()
+	room, err := h.loadRoom(d.code, false)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	h.dropMu.Lock()
+	data, err := json.Marshal(d.Drop)
+	h.dropMu.Unlock()
+	if err != nil {
+		return err
+	}
+	msg := SignalMessage{Code: d.code, From: d.From, To: d.To, Type: EventDropReady, Data: data}
+	for _, other := range room.Peers {
+		if other.Name != d.From && (d.To == "" || d.To == other.Name) {
+			other.notify(msg, h.cfg.Limits)
+			h.wake(other.Token)
+		}
+	}
+	return h.store.SaveRoom(room)
+}
+
+// DropStatus reports how far drop id has been uploaded, for an uploader
+// resuming or a recipient waiting for it
+func (h *Hub) DropStatus(token, id string) (Drop, error) {
+	d, _, err := h.findDrop(token, id)
+	if err != nil {
+		return Drop{}, err
+	}
+	h.dropMu.Lock()
+	defer h.dropMu.Unlock()
+	return d.Drop, nil
+}
+
+// ReadDrop writes drop id from offset on to w once it is complete, for a
+// recipient; start is called with the drop before the first byte so the
+// caller can set headers. A copy that fails part way can be resumed from a
+// later offset; once one reaches the end the drop is deleted, after a short
+// grace in which only that member's resumes are served.
+func (h *Hub) ReadDrop(token, id string, offset int64, w io.Writer, start func(Drop)) error {
+	d, p, err := h.findDrop(token, id)
+	if err != nil {
+		return err
+	}
+	if p.Name == d.From || (d.To != "" && d.To != p.Name) {
+		return ErrNotRecipient
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.complete() {
+		return ErrDropIncomplete
+	}
+	if offset < 0 || offset >= d.Size {
+		return ErrDropOffset
+	}
+	if d.taker != "" && (d.taker != p.Name || offset == 0) {
+		return ErrDropNotFound
+	}
+	f, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	start(d.Drop)
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	if d.taker != "" {
+		return nil
+	}
+	d.taker = p.Name
+	h.dropMu.Lock()
+	if grace := time.Now().Add(dropGrace); grace.Before(d.Expires) {
+		d.Expires = grace
+	}
+	h.dropMu.Unlock()
+	time.AfterFunc(dropGrace, func() { h.deleteDrop(d) })
+	return nil
+}
+
+// CancelDrop deletes drop id on behalf of its uploader
+func (h *Hub) CancelDrop(token, id string) error {
+	d, p, err := h.findDrop(token, id)
+	if err != nil {
+		return err
+	}
+	if p.Name != d.From {
+		return ErrNotRecipient
+	}
+	h.deleteDrop(d)
+	return nil
+}
+
+// findDrop finds drop id for a member of its room, the peer owning token
+func (h *Hub) findDrop(token, id string) (*drop, *Peer, error) {
+	_, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock()
+	h.dropMu.Lock()
+	d := h.drops[id]
+	h.dropMu.Unlock()
+	if d == nil || d.code != p.Code {
+		return nil, nil, ErrDropNotFound
+	}
+	h.dropMu.Lock()
+	expired := time.Now().After(d.Expires)
+	h.dropMu.Unlock()
+	if expired {
+		return nil, nil, ErrDropNotFound
+	}
+	return d, p, nil
+}
+
+// deleteDrop forgets d and removes its file
+func (h *Hub) deleteDrop(d *drop) {
+	h.dropMu.Lock()
+	delete(h.drops, d.ID)
+	h.dropMu.Unlock()
+	if err := os.Remove(d.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		h.logger.Println("webrtc: removing drop:", err)
+	}
+}
+
+// expireDrops deletes every drop past its TTL, downloaded or not
+func (h *Hub) expireDrops(now time.Time) {
+	h.dropMu.Lock()
+	var expired []*drop
+	for _, d := range h.drops {
+		if now.After(d.Expires) {
+			expired = append(expired, d)
+		}
+	}
+	h.dropMu.Unlock()
+	for _, d := range expired {
+		h.deleteDrop(d)
+	}
+}
+
+// handleDrops announces an upload: {"name", "type", "size", "to"}
+func (h *Hub) handleDrops(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+		Type string `json:"type,omitempty"`
+		Size int64  `json:"size"`
+		To   string `json:"to,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	d, err := h.CreateDrop(peerToken(r), req.Name, req.Type, req.Size, req.To)
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "id": d.ID, "expires": d.Expires, "chunk": maxDropChunk})
+}
+
+// handleDrop serves one drop: PATCH ?offset=N uploads the next chunk, GET
+// downloads it (a "Range: bytes=N-" header resumes), ?status reports
+// progress as JSON, and DELETE cancels it
+func (h *Hub) handleDrop(w http.ResponseWriter, r *http.Request) {
+	token, id := peerToken(r), r.PathValue("id")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Has("status"):
+		d, err := h.DropStatus(token, id)
+		if err != nil {
+			h.httpError(w, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(d)
+	case r.Method == http.MethodPatch:
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		if r.ContentLength > maxDropChunk {
+			h.httpError(w, ErrDropTooLarge)
+			return
+		}
+		offset, err = h.WriteDrop(token, id, offset, r.Body)
+		if errors.Is(err, ErrDropOffset) {
+			// tell the client where to resume from
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		}
+		if err != nil {
+			h.httpError(w, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "offset": offset})
+	case r.Method == http.MethodGet:
+		offset, ok := rangeStart(r.Header.Get("Range"))
+		if !ok {
+			http.Error(w, "only bytes=N- ranges are supported", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		err := h.ReadDrop(token, id, offset, w, func(d Drop) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(d.Name))
+			w.Header().Set("Content-Length", strconv.FormatInt(d.Size-offset, 10))
+			w.Header().Set("Cache-Control", "no-store")
+			if offset > 0 {
+				w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(d.Size-1, 10)+"/"+strconv.FormatInt(d.Size, 10))
+				w.WriteHeader(http.StatusPartialContent)
+			}
+		})
+		// once the body has started there is no status left to report
+		if err != nil && w.Header().Get("Content-Length") == "" {
+			h.httpError(w, err)
+		}
+	case r.Method == http.MethodDelete:
+		if err := h.CancelDrop(token, id); err != nil {
+			h.httpError(w, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// rangeStart parses an absent Range header or one of the form "bytes=N-"
+func rangeStart(header string) (int64, bool) {
+	if header == "" {
+		return 0, true
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, false
+	}
+	start, ok := strings.CutSuffix(spec, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, err == nil && n >= 0
+}
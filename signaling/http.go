@@ -0,0 +1,422 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"galacticApps/middleware"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// ServeHTTP serves the signaling endpoints; mount the Hub at /webrtc/
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Hub) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webrtc/pair", h.handlePair)
+	mux.HandleFunc("/webrtc/pair/qr", h.handlePairQR)
+	mux.HandleFunc("/webrtc/join", h.handleJoin)
+	mux.HandleFunc("/webrtc/create", h.handleCreate)
+	mux.HandleFunc("/webrtc/signal", h.handleSignal)
+	mux.HandleFunc("/webrtc/poll", h.handlePoll)
+	mux.HandleFunc("/webrtc/leave", h.handleLeave)
+	mux.HandleFunc("/webrtc/kick", h.handleKick)
+	mux.HandleFunc("/webrtc/close", h.handleClose)
+	mux.HandleFunc("/webrtc/ice-servers", h.handleICEServers)
+	mux.HandleFunc("/webrtc/state", h.handleState)
+	mux.HandleFunc("/webrtc/devices/challenge", h.handleDeviceChallenge)
+	mux.HandleFunc("/webrtc/devices/register", h.handleDeviceRegister)
+	mux.HandleFunc("/webrtc/devices/connect", h.handleDeviceConnect)
+	mux.HandleFunc("/webrtc/devices/unpair", h.handleDeviceUnpair)
+	mux.HandleFunc("/webrtc/drops", h.handleDrops)
+	mux.HandleFunc("/webrtc/drops/{id}", h.handleDrop)
+	mux.HandleFunc("/webrtc/ws", h.handleWS)
+	return mux
+}
+
+// peerToken extracts the peer token from the X-Peer-Token header, falling
+// back to the token query parameter for clients that cannot set headers
+func peerToken(r *http.Request) string {
+	if t := r.Header.Get("X-Peer-Token"); t != "" {
+		return t
+	}
+	return r.URL.Query().Get("token")
+}
+
+// httpError maps a Hub error to its HTTP status, logging anything unexpected
+func (h *Hub) httpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUnauthorized), errors.Is(err, ErrBadChallenge), errors.Is(err, ErrBadSignature):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, ErrTargetNotFound), errors.Is(err, ErrUnknownDevice), errors.Is(err, ErrDropNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrMessageTooLarge), errors.Is(err, ErrStateFull), errors.Is(err, ErrDropTooLarge),
+		errors.Is(err, ErrDropFull):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, ErrQueueFull), errors.Is(err, ErrRelayLimit):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, ErrCodeExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, ErrNameTaken), errors.Is(err, ErrRoomFull), errors.Is(err, ErrRoomExists),
+		errors.Is(err, ErrVersionConflict), errors.Is(err, ErrDropIncomplete):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrDropOffset):
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+	case errors.Is(err, ErrInvalidKey):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNotHost), errors.Is(err, ErrNotPaired), errors.Is(err, ErrNotRecipient),
+		errors.Is(err, ErrNotPairingRoom):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		h.logger.Println("webrtc:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+func (h *Hub) handleJoin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+		Code string `json:"code"`
+		// Token resumes the member already called Name, and OnConflict
+		// ("reject" or "suffix") decides what happens if it is someone else
+		Token      string       `json:"token,omitempty"`
+		OnConflict NameConflict `json:"onConflict,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if req.Code == "" || req.Name == "" {
+		http.Error(w, "missing name or code", http.StatusBadRequest)
+		return
+	}
+	if !validConflict(req.OnConflict) {
+		http.Error(w, "invalid onConflict", http.StatusBadRequest)
+		return
+	}
+
+	// the address is whatever we see the request come from, never what the
+	// client claims
+	m, err := h.Join(req.Code, req.Name, JoinOptions{IP: middleware.GetClientIP(r), Token: req.Token, OnConflict: req.OnConflict})
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	h.writeMembership(w, r, m)
+}
+
+// handleCreate pre-creates a room for its host, under the requested code or
+// a minted one, so signals for members who have not joined yet can be held
+func (h *Hub) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+		Code string `json:"code,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+
+	m, err := h.Create(req.Code, req.Name, JoinOptions{IP: middleware.GetClientIP(r)})
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	h.writeMembership(w, r, m)
+}
+
+// writeMembership answers a join or create
+func (h *Hub) writeMembership(w http.ResponseWriter, r *http.Request, m *Membership) {
+	servers, _, err := h.ICEServers(m.Peer.Token, r.Host)
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+
+	// return the peer token, the name actually taken, the host and list of
+	// other participants (and which of them share our public address), and
+	// where to find STUN/TURN so the client can start gathering candidates
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"status":      "ok",
+		"code":        m.Peer.Code,
+		"token":       m.Peer.Token,
+		"name":        m.Peer.Name,
+		"host":        m.Host,
+		"peers":       m.Others,
+		"sameNetwork": m.SameNetwork,
+		"iceServers":  servers,
+	})
+}
+
+// validConflict reports whether c is empty or a known NameConflict
+func validConflict(c NameConflict) bool {
+	return c == "" || c == ConflictReject || c == ConflictSuffix
+}
+
+func (h *Hub) handleSignal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var msg SignalMessage
+	// leave headroom for the JSON envelope around Data
+	r.Body = http.MaxBytesReader(w, r.Body, int64(h.cfg.Limits.MaxMessageBytes)+1024)
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			h.httpError(w, ErrMessageTooLarge)
+			return
+		}
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if msg.Type == "" {
+		http.Error(w, "missing fields", http.StatusBadRequest)
+		return
+	}
+
+	// if To specified, deliver to that participant, otherwise broadcast to others
+	if err := h.Signal(peerToken(r), msg); err != nil {
+		h.httpError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
+}
+
+func (h *Hub) handlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// optional long-poll: ?wait=N parks the request for up to N seconds
+	// until something is queued for this peer
+	var opts PollOptions
+	if v := r.URL.Query().Get("wait"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		opts.Wait = time.Duration(secs) * time.Second
+	}
+	// optional acknowledgement: ?ack=N confirms everything up to seq N and
+	// keeps later messages for replay until they are confirmed too
+	if v := r.URL.Query().Get("ack"); v != "" {
+		seq, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid ack", http.StatusBadRequest)
+			return
+		}
+		opts.Ack = &seq
+	}
+
+	msgs, err := h.Poll(r.Context(), peerToken(r), opts)
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	if msgs == nil {
+		msgs = []SignalMessage{}
+	}
+	_ = json.NewEncoder(w).Encode(msgs)
+}
+
+func (h *Hub) handleLeave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.Leave(peerToken(r)); err != nil {
+		h.httpError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
+}
+
+func (h *Hub) handleKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	if err := h.Kick(peerToken(r), req.Name); err != nil {
+		h.httpError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
+}
+
+func (h *Hub) handleClose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.CloseRoom(peerToken(r)); err != nil {
+		h.httpError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
+}
+
+// handleWS is the WebSocket transport for the same rooms: joining happens on
+// connect, every frame in either direction is a SignalMessage, and queued
+// messages are pushed as soon as they arrive instead of waiting for a poll.
+//
+// Connecting with ?ack switches to acknowledged delivery: the client sends
+// {"type":"ack","seq":N} frames, the peer outlives a dropped socket, and
+// reconnecting with ?token= resumes it and replays anything unacknowledged.
+func (h *Hub) handleWS(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	token := q.Get("token")
+	code := q.Get("code")
+	name := q.Get("name")
+	acked := q.Has("ack")
+	conflict := NameConflict(q.Get("onConflict"))
+	if token == "" && (code == "" || name == "") {
+		http.Error(w, "missing code or name", http.StatusBadRequest)
+		return
+	}
+	if !validConflict(conflict) {
+		http.Error(w, "invalid onConflict", http.StatusBadRequest)
+		return
+	}
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		h.logger.Println("webrtc ws accept failed:", err)
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(int64(h.cfg.Limits.MaxMessageBytes) + 1024)
+
+	var m *Membership
+	if token != "" {
+		m, err = h.Resume(token)
+	} else {
+		m, err = h.Join(code, name, JoinOptions{IP: middleware.GetClientIP(r), OnConflict: conflict})
+	}
+	if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrNameTaken) ||
+		errors.Is(err, ErrRoomFull) || errors.Is(err, ErrCodeExpired) || errors.Is(err, ErrNotPaired) {
+		conn.Close(websocket.StatusPolicyViolation, err.Error())
+		return
+	}
+	if err != nil {
+		h.logger.Println("webrtc ws join failed:", err)
+		conn.Close(websocket.StatusInternalError, "join failed")
+		return
+	}
+	peer := m.Peer
+	code, name = peer.Code, peer.Name
+	notify := h.park(peer.Token)
+	defer h.unpark(peer.Token)
+
+	// leave the room when the socket goes away (a no-op if a newer join under
+	// the same name already replaced us), unless the client can resume
+	if !acked {
+		defer h.Leave(peer.Token)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// the socket itself authenticates this peer; the token is handed out so
+	// the client can fall back to HTTP polling or resume without rejoining
+	joined, _ := json.Marshal(map[string]any{"token": peer.Token, "name": name, "host": m.Host, "peers": m.Others, "sameNetwork": m.SameNetwork})
+	if err := wsjson.Write(ctx, conn, SignalMessage{Code: code, To: name, Type: "joined", Data: joined}); err != nil {
+		return
+	}
+
+	// reader: route every incoming frame exactly like /webrtc/signal
+	go func() {
+		defer cancel()
+		for {
+			var msg SignalMessage
+			if err := wsjson.Read(ctx, conn, &msg); err != nil {
+				return
+			}
+			var err error
+			switch msg.Type {
+			case "":
+				continue
+			case "ack":
+				err = h.Ack(peer.Token, msg.Seq)
+			default:
+				err = h.Signal(peer.Token, msg)
+			}
+			if err != nil {
+				data, _ := json.Marshal(map[string]string{"error": err.Error(), "to": msg.To})
+				_ = wsjson.Write(ctx, conn, SignalMessage{Code: code, To: name, Type: "error", Data: data})
+			}
+		}
+	}()
+
+	// writer: push queued messages whenever the peer is notified, and ping
+	// periodically so a live socket keeps the peer from being reaped. An
+	// acknowledging client first gets everything unacknowledged replayed.
+	mode := deliverOnce
+	if acked {
+		mode = deliverUnacked
+	}
+	keepalive := time.NewTicker(h.cfg.PeerTimeout / 3)
+	defer keepalive.Stop()
+	for {
+		// evicted by the janitor, replaced by a newer join or the room was
+		// closed: flush the final messages and hang up
+		msgs, gone, err := h.drain(peer.Token, mode, nil)
+		if err != nil {
+			h.logger.Println("webrtc ws:", err)
+			return
+		}
+		for _, msg := range msgs {
+			if err := wsjson.Write(ctx, conn, msg); err != nil {
+				return
+			}
+		}
+		if gone {
+			conn.Close(websocket.StatusNormalClosure, "left room")
+			return
+		}
+		if acked {
+			mode = deliverNew
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepalive.C:
+			pingCtx, cancelPing := context.WithTimeout(ctx, h.cfg.PeerTimeout/3)
+			err := conn.Ping(pingCtx)
+			cancelPing()
+			if err != nil {
+				return
+			}
+		case <-notify:
+		}
+	}
+}
@@ -0,0 +1,840 @@
+package signaling
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPollWait caps how long a long-poll may park a request
+const maxPollWait = 30 * time.Second
+
+// Hub routes SignalMessages between the peers of rooms kept in a Store, and
+// through a Broker to room members connected to other instances
+type Hub struct {
+	id     string // identifies this instance on the Broker
+	store  Store
+	broker Broker
+	cfg    Config
+	logger *log.Logger
+	mux    *http.ServeMux
+
+	// rooms serializes every load-modify-save of a room; each of the
+	// mutexes below is only ever taken after it, never the other way round
+	rooms roomLocks
+
+	waitMu  sync.Mutex
+	waiters map[string]*waiter  // peer token -> parked transports
+	final   map[string]farewell // peer token -> messages left when it was removed
+
+	remoteMu sync.Mutex
+	remote   map[string]map[string]*remotePeer // room code -> name -> member on another instance
+
+	outMu   sync.Mutex
+	outbox  []Envelope    // waiting for the publisher, in order
+	sending bool          // the publisher is handing envelopes to the Broker
+	outIdle *sync.Cond    // on outMu; broadcast whenever the publisher runs dry
+	outWake chan struct{} // nudges the publisher
+
+	relayMu sync.Mutex
+	relay   map[string]*relayBucket // room code -> relay bandwidth left
+
+	dropMu sync.Mutex
+	drops  map[string]*drop // drop ID -> file waiting on local disk
+
+	deviceKey      []byte // signs device challenges
+	challengeMu    sync.Mutex
+	usedChallenges map[string]time.Time // challenge -> its expiry
+}
+
+// waiter lets /webrtc/poll and /webrtc/ws sleep until something is queued
+type waiter struct {
+	ch chan struct{}
+	n  int
+}
+
+// farewell is what a removed peer was left with (e.g. room-closed), kept
+// for its next poll: the one parked at the time or, for a client polling on
+// an interval, the one after
+type farewell struct {
+	msgs    []SignalMessage
+	expires time.Time
+}
+
+func NewHub(store Store, broker Broker, cfg Config, logger *log.Logger) (*Hub, error) {
+	id, err := genToken()
+	if err != nil {
+		return nil, err
+	}
+	deviceKey := []byte(cfg.DeviceSecret)
+	if len(deviceKey) == 0 {
+		if deviceKey, err = hex.DecodeString(id); err != nil {
+			return nil, err
+		}
+	}
+	h := &Hub{
+		id:             id[:16],
+		store:          store,
+		broker:         broker,
+		cfg:            cfg,
+		logger:         logger,
+		waiters:        make(map[string]*waiter),
+		final:          make(map[string]farewell),
+		remote:         make(map[string]map[string]*remotePeer),
+		relay:          make(map[string]*relayBucket),
+		drops:          make(map[string]*drop),
+		deviceKey:      deviceKey,
+		usedChallenges: make(map[string]time.Time),
+		outWake:        make(chan struct{}, 1),
+	}
+	h.outIdle = sync.NewCond(&h.outMu)
+	if err := prepareDrops(cfg.Drop.Dir); err != nil {
+		return nil, err
+	}
+	h.mux = h.routes()
+	broker.Subscribe(h.receive)
+	go h.publisher()
+	return h, nil
+}
+
+// JoinOptions tunes a Join
+type JoinOptions struct {
+	// IP is the address the server saw the join come from
+	IP string
+	// Token, when it belongs to the member already called name, resumes
+	// that member instead of treating the name as taken
+	Token string
+	// OnConflict decides what happens when name is taken; empty means the
+	// configured default
+	OnConflict NameConflict
+
+	device string // set by ConnectDevice for the Device joining
+}
+
+// Membership is a peer's view of its room right after joining or resuming
+type Membership struct {
+	Peer   *Peer
+	Others []string // everyone else in the room, on any instance
+	Host   string   // the member allowed to kick others and close the room
+	// SameNetwork lists the local members behind the same public address,
+	// a hint that they share a LAN and host candidates will do
+	SameNetwork []string
+}
+
+// Join adds a fresh peer called name to room code, or resumes the existing
+// one when opts carries its token. The first member of a room becomes its
+// host; nobody joins once the room holds MaxPeers. Rooms of paired devices
+// are only reachable through ConnectDevice. Codes are normalized first, so
+// "abc-234" joins ABC234.
+func (h *Hub) Join(code, name string, opts JoinOptions) (*Membership, error) {
+	code = normalizeCode(code)
+	if strings.HasPrefix(code, deviceRoomPrefix) {
+		return nil, ErrNotPaired
+	}
+	token, err := genToken()
+	if err != nil {
+		return nil, err
+	}
+
+	defer h.flush()
+	defer h.rooms.lock(code)()
+	room, err := h.loadRoom(code, true)
+	if err != nil {
+		return nil, err
+	}
+	return h.admit(room, name, token, opts)
+}
+
+// Create opens room code with the peer called name as its host, failing with
+// ErrRoomExists if anyone already uses the code. An empty code gets a
+// freshly minted pairing code instead. Messages the host sends to members
+// that have not joined yet are held for them.
+func (h *Hub) Create(code, name string, opts JoinOptions) (*Membership, error) {
+	token, err := genToken()
+	if err != nil {
+		return nil, err
+	}
+
+	defer h.flush()
+	if code = normalizeCode(code); code == "" {
+		return h.mint(name, token, opts, time.Time{})
+	}
+	return h.open(code, name, token, opts, time.Time{})
+}
+
+// mint opens a room under a freshly minted pairing code no room uses yet,
+// here or on another instance
+func (h *Hub) mint(name, token string, opts JoinOptions, expires time.Time) (*Membership, error) {
+	for range 10 {
+		code, err := genPairingCode()
+		if err != nil {
+			return nil, err
+		}
+		m, err := h.open(code, name, token, opts, expires)
+		if !errors.Is(err, ErrRoomExists) {
+			return m, err
+		}
+	}
+	return nil, errors.New("no free pairing code")
+}
+
+// open starts room code, expiring at expires if that is set, with the peer
+// called name as its host, or fails with ErrRoomExists
+func (h *Hub) open(code, name, token string, opts JoinOptions, expires time.Time) (*Membership, error) {
+	if strings.HasPrefix(code, deviceRoomPrefix) {
+		return nil, ErrNotPaired
+	}
+	defer h.rooms.lock(code)()
+	_, err := h.store.LoadRoom(code)
+	if err == nil || h.remoteCount(code) > 0 {
+		return nil, ErrRoomExists
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	room := newRoom(code)
+	room.Expires = expires
+	return h.admit(room, name, token, opts)
+}
+
+// admit lets the peer called name into room under token, applying resume,
+// expiry, name-collision and capacity rules, and hands it whatever was held
+// for it. Callers must hold the room's lock.
+func (h *Hub) admit(room *Room, name, token string, opts JoinOptions) (*Membership, error) {
+	code := room.Code
+	now := time.Now()
+	if old := room.Peers[name]; old != nil && opts.Token != "" && old.Token == opts.Token {
+		old.LastSeen = now
+		if opts.IP != "" {
+			old.IP = opts.IP
+		}
+		if err := h.store.SaveRoom(room); err != nil {
+			return nil, err
+		}
+		return h.membership(room, old), nil
+	}
+	if !room.Expires.IsZero() && now.After(room.Expires) {
+		return nil, ErrCodeExpired
+	}
+
+	if h.nameTaken(room, name) {
+		policy := opts.OnConflict
+		if policy == "" {
+			policy = h.cfg.NameConflict
+		}
+		switch old := room.Peers[name]; {
+		case policy == conflictReplace && old != nil:
+			h.removePeer(room, old, EventPeerLeft)
+		case policy == ConflictSuffix:
+			name = h.freeName(room, name)
+		default:
+			// including a session to replace that lives on another
+			// instance; it has to time out there first
+			return nil, ErrNameTaken
+		}
+	}
+	if len(room.Peers)+h.remoteCount(code) >= h.cfg.MaxPeers {
+		return nil, ErrRoomFull
+	}
+
+	p := &Peer{
+		Name:     name,
+		Code:     code,
+		IP:       opts.IP,
+		Device:   opts.device,
+		Token:    token,
+		Queue:    []queued{},
+		Joined:   now,
+		LastSeen: now,
+	}
+	for _, other := range room.Peers {
+		other.notify(joinedEvent(code, name, sameNetwork(p, other)), h.cfg.Limits)
+		h.wake(other.Token)
+	}
+	joined := presence(code, EventPeerJoined, name)
+	room.Peers[name] = p
+	room.Idle = time.Time{}
+	if prev := room.Host; h.electHost(room) && prev != "" {
+		h.notifyRoom(room, name, presence(code, EventHostChanged, room.Host))
+	}
+	for _, msg := range room.takeHeld(name, now) {
+		p.push(msg)
+	}
+	if err := h.store.SaveRoom(room); err != nil {
+		return nil, err
+	}
+	env := Envelope{Kind: KindPresence, Code: code, Msg: joined, Joined: map[string]time.Time{name: now}}
+	if !room.State.empty() {
+		env.State = room.State
+	}
+	h.publish(env)
+	return h.membership(room, p), nil
+}
+
+// Resume looks up the peer owning token for a transport reconnecting to it
+func (h *Hub) Resume(token string) (*Membership, error) {
+	room, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	p.LastSeen = time.Now()
+	if err := h.store.SaveRoom(room); err != nil {
+		return nil, err
+	}
+	return h.membership(room, p), nil
+}
+
+// Signal routes msg on behalf of the peer owning token. Code and From are
+// always overwritten: the token decides who is talking, never the payload.
+func (h *Hub) Signal(token string, msg SignalMessage) error {
+	defer h.flush()
+	room, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	msg.Code = p.Code
+	msg.From = p.Name
+	if msgSize(msg) > h.cfg.Limits.MaxMessageBytes {
+		return ErrMessageTooLarge
+	}
+	if msg.Type == TypeRelay {
+		if msg.To == "" || msg.To == p.Name || (room.Peers[msg.To] == nil && !h.isRemote(room.Code, msg.To)) {
+			return ErrTargetNotFound
+		}
+		if !h.relayAllow(room.Code, msgSize(msg), time.Now()) {
+			return ErrRelayLimit
+		}
+	}
+
+	// a target on another instance is only reachable through the broker,
+	// and one that has not joined yet gets the message when it does
+	if msg.To != "" && room.Peers[msg.To] == nil {
+		if h.isRemote(room.Code, msg.To) {
+			h.publish(Envelope{Kind: KindSignal, Code: room.Code, Msg: msg})
+			return nil
+		}
+		if err := room.hold(msg, time.Now().Add(h.cfg.HoldTTL), h.cfg.Limits); err != nil {
+			return err
+		}
+		return h.store.SaveRoom(room)
+	}
+
+	targets, err := room.route(msg, h.cfg.Limits)
+	if err != nil {
+		return err
+	}
+	if err := h.store.SaveRoom(room); err != nil {
+		return err
+	}
+	for _, t := range targets {
+		h.wake(t.Token)
+	}
+	if msg.To == "" && h.remoteCount(room.Code) > 0 {
+		h.publish(Envelope{Kind: KindSignal, Code: room.Code, Msg: msg})
+	}
+	return nil
+}
+
+// PollOptions tunes a Poll
+type PollOptions struct {
+	// Wait parks the poll until something is queued, up to this long
+	Wait time.Duration
+	// Ack, when set, acknowledges every message up to and including *Ack and
+	// makes the poll return everything still unacknowledged; without it
+	// messages are forgotten as soon as they are returned
+	Ack *uint64
+}
+
+// Poll returns what is queued for the peer owning token. With a non-zero
+// wait it parks until a message arrives, the peer is removed, or wait elapses.
+// The first poll after the peer was removed returns what it was left with;
+// later ones fail with ErrUnauthorized.
+func (h *Hub) Poll(ctx context.Context, token string, opts PollOptions) ([]SignalMessage, error) {
+	_, _, unlock, err := h.authenticate(token)
+	if errors.Is(err, ErrUnauthorized) {
+		if msgs := h.takeFinal(token); len(msgs) > 0 {
+			return msgs, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	unlock()
+
+	// stay well inside the reaper timeout so a parked poller is never evicted
+	wait := min(opts.Wait, maxPollWait, h.cfg.PeerTimeout/2)
+	mode := deliverOnce
+	if opts.Ack != nil {
+		mode = deliverUnacked
+	}
+	notify := h.park(token)
+	defer h.unpark(token)
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for {
+		msgs, gone, err := h.drain(token, mode, opts.Ack)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 || wait == 0 || gone {
+			return msgs, nil
+		}
+
+		// park without holding the room lock; Signal, Leave and the janitor wake us
+		select {
+		case <-notify:
+			continue
+		case <-deadline.C:
+		case <-ctx.Done():
+		}
+		wait = 0
+	}
+}
+
+// Ack discards every message queued for the peer owning token up to and
+// including seq
+func (h *Hub) Ack(token string, seq uint64) error {
+	room, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	p.ack(seq)
+	return h.store.SaveRoom(room)
+}
+
+// Leave removes the peer owning token from its room
+func (h *Hub) Leave(token string) error {
+	defer h.flush()
+	room, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	h.removePeer(room, p, EventPeerLeft)
+	return h.commit(room)
+}
+
+// Kick removes the member called name on behalf of the room's host, who
+// owns token. A member on another instance is removed by that instance.
+func (h *Hub) Kick(token, name string) error {
+	defer h.flush()
+	room, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if p.Name != room.Host {
+		return ErrNotHost
+	}
+	target := room.Peers[name]
+	if target == nil {
+		if !h.isRemote(room.Code, name) {
+			return ErrTargetNotFound
+		}
+		h.publish(Envelope{Kind: KindKick, Code: room.Code, Msg: presence(room.Code, EventPeerKicked, name)})
+		return nil
+	}
+	h.kick(room, target)
+	return h.commit(room)
+}
+
+// CloseRoom ends the room on behalf of its host, who owns token: every
+// member, here or on another instance, is told room-closed and removed.
+func (h *Hub) CloseRoom(token string) error {
+	defer h.flush()
+	room, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if p.Name != room.Host {
+		return ErrNotHost
+	}
+	return h.closeRoom(room)
+}
+
+// Reap evicts every peer that has not been seen within the configured
+// timeout, discards held messages past their TTL and state documents
+// StateTTL after their room emptied, drops rooms left with nothing and tells
+// the survivors who went away.
+func (h *Hub) Reap() (int, error) {
+	defer h.flush()
+	cutoff := time.Now().Add(-h.cfg.PeerTimeout)
+	h.expireRelay(time.Now())
+	h.expireDrops(time.Now())
+	h.expireFinal(time.Now())
+	if err := h.expireRemote(cutoff); err != nil {
+		return 0, err
+	}
+	codes, err := h.store.Rooms()
+	if err != nil {
+		return 0, err
+	}
+	reaped := 0
+	for _, code := range codes {
+		n, err := h.reapRoom(code, cutoff)
+		reaped += n
+		if err != nil {
+			return reaped, err
+		}
+	}
+	return reaped, nil
+}
+
+// reapRoom is Reap for a single room
+func (h *Hub) reapRoom(code string, cutoff time.Time) (int, error) {
+	defer h.rooms.lock(code)()
+	room, err := h.loadRoom(code, false)
+	if err != nil {
+		return 0, ignoreNotFound(err)
+	}
+	now := time.Now()
+	stale := room.expireHeld(now)
+	if len(room.Peers) == 0 && !room.Idle.IsZero() && now.After(room.Idle.Add(h.cfg.StateTTL)) {
+		room.State = nil
+		stale = true
+	}
+	reaped := 0
+	for _, p := range room.Peers {
+		if p.LastSeen.Before(cutoff) {
+			h.removePeer(room, p, EventPeerTimedOut)
+			stale = true
+			reaped++
+		}
+	}
+	if !stale {
+		return 0, nil
+	}
+	return reaped, h.commit(room)
+}
+
+// Run is the janitor: peers that close their tab without leaving stop
+// polling, so periodically evict anyone idle for longer than PeerTimeout.
+// It also re-announces local members so other instances keep them alive.
+func (h *Hub) Run() {
+	ticker := time.NewTicker(h.cfg.PeerTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := h.announceAll(); err != nil {
+			h.logger.Println("webrtc: announce failed:", err)
+		}
+		h.flush()
+
+		n, err := h.Reap()
+		if err != nil {
+			h.logger.Println("webrtc: reaper failed:", err)
+		}
+		if n > 0 {
+			h.logger.Println("webrtc: reaped", n, "stale peers")
+		}
+	}
+}
+
+// CloseAll tells every room it is closing and evicts all peers, returning
+// once the other instances have been told too
+func (h *Hub) CloseAll() error {
+	defer h.settle()
+	codes, err := h.store.Rooms()
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if err := h.shutRoom(code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shutRoom is CloseAll for a single room
+func (h *Hub) shutRoom(code string) error {
+	defer h.rooms.lock(code)()
+	room, err := h.loadRoom(code, false)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	// the room only closes here; elsewhere these peers just left
+	for _, p := range room.Peers {
+		h.publish(Envelope{Kind: KindPresence, Code: code, Msg: presence(code, EventPeerLeft, p.Name)})
+	}
+	return h.dropRoom(room)
+}
+
+// membership describes room as seen by p. Callers must hold the room's lock.
+func (h *Hub) membership(room *Room, p *Peer) *Membership {
+	m := &Membership{
+		Peer:        p,
+		Others:      append(room.others(p.Name), h.remoteNames(room.Code, p.Name)...),
+		Host:        room.Host,
+		SameNetwork: []string{},
+	}
+	for name, other := range room.Peers {
+		if name != p.Name && sameNetwork(p, other) {
+			m.SameNetwork = append(m.SameNetwork, name)
+		}
+	}
+	return m
+}
+
+// nameTaken reports whether name is in use in room on any instance.
+// Callers must hold the room's lock.
+func (h *Hub) nameTaken(room *Room, name string) bool {
+	return room.Peers[name] != nil || h.isRemote(room.Code, name)
+}
+
+// freeName picks the first of name-2, name-3, ... not in use in room.
+// Callers must hold the room's lock.
+func (h *Hub) freeName(room *Room, name string) string {
+	for i := 2; ; i++ {
+		candidate := name + "-" + strconv.Itoa(i)
+		if !h.nameTaken(room, candidate) {
+			return candidate
+		}
+	}
+}
+
+// kick removes target from room, making sure it hears why before its
+// transport hangs up. Callers must hold the room's lock and commit it afterwards.
+func (h *Hub) kick(room *Room, target *Peer) {
+	target.notify(presence(room.Code, EventPeerKicked, target.Name), h.cfg.Limits)
+	h.removePeer(room, target, EventPeerKicked)
+}
+
+// closeRoom tells every member of room, here and elsewhere, that it is
+// closed and deletes it. Callers must hold the room's lock.
+func (h *Hub) closeRoom(room *Room) error {
+	h.publish(Envelope{Kind: KindPresence, Code: room.Code, Msg: presence(room.Code, EventRoomClosed, "")})
+	return h.dropRoom(room)
+}
+
+// dropRoom queues room-closed for the local members of room, releases their
+// transports and deletes it. Callers must hold the room's lock.
+func (h *Hub) dropRoom(room *Room) error {
+	h.notifyRoom(room, "", presence(room.Code, EventRoomClosed, ""))
+	for _, p := range room.Peers {
+		h.retire(p)
+	}
+	return h.store.DeleteRoom(room.Code)
+}
+
+// authenticate resolves token to its room and peer and takes the room's
+// lock; on success the caller must call unlock once done with them.
+func (h *Hub) authenticate(token string) (room *Room, p *Peer, unlock func(), err error) {
+	if token == "" {
+		return nil, nil, nil, ErrUnauthorized
+	}
+	// a token never moves between rooms, so the lookup needs no lock
+	code, err := h.store.LookupToken(token)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil, nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	unlock = h.rooms.lock(code)
+	room, err = h.loadRoom(code, false)
+	if errors.Is(err, ErrNotFound) {
+		err = ErrUnauthorized
+	}
+	if err == nil {
+		if p = room.peer(token); p == nil {
+			err = ErrUnauthorized
+		}
+	}
+	if err != nil {
+		unlock()
+		return nil, nil, nil, err
+	}
+	return room, p, unlock, nil
+}
+
+// drain applies ack (if any), hands over the messages selected by mode and
+// marks the peer as seen. Once the peer has been removed it returns the
+// messages it was left with (e.g. room-closed) and gone=true.
+func (h *Hub) drain(token string, mode delivery, ack *uint64) (msgs []SignalMessage, gone bool, err error) {
+	room, p, unlock, err := h.authenticate(token)
+	if errors.Is(err, ErrUnauthorized) {
+		return h.takeFinal(token), true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+	if ack != nil {
+		p.ack(*ack)
+	}
+	now := time.Now()
+	msgs = p.take(mode, h.cfg.ReplayWindow, now)
+	p.LastSeen = now
+	return msgs, false, h.store.SaveRoom(room)
+}
+
+// loadRoom fetches room code from the store, optionally starting a new one
+// when it does not exist yet. Callers must hold the room's lock.
+func (h *Hub) loadRoom(code string, create bool) (*Room, error) {
+	room, err := h.store.LoadRoom(code)
+	if errors.Is(err, ErrNotFound) && create {
+		return newRoom(code), nil
+	}
+	return room, err
+}
+
+// commit saves room, or deletes it once the last peer is gone and nothing is
+// held for anyone still expected nor kept in its state document. An empty
+// room that is kept is marked Idle. Callers must hold the room's lock.
+func (h *Hub) commit(room *Room) error {
+	switch {
+	case len(room.Peers) > 0:
+		room.Idle = time.Time{}
+	case len(room.Held) == 0 && room.State.empty():
+		return h.store.DeleteRoom(room.Code)
+	case room.Idle.IsZero():
+		room.Idle = time.Now()
+	}
+	return h.store.SaveRoom(room)
+}
+
+// removePeer takes p out of room and tells whoever is left with event (if
+// non-empty). When p was the host, the longest-standing member left takes
+// over. Callers must hold the room's lock and commit it afterwards.
+func (h *Hub) removePeer(room *Room, p *Peer, event string) {
+	delete(room.Peers, p.Name)
+	h.retire(p)
+	if event != "" {
+		msg := presence(room.Code, event, p.Name)
+		h.notifyRoom(room, "", msg)
+		h.publish(Envelope{Kind: KindPresence, Code: room.Code, Msg: msg})
+	}
+	if p.Name == room.Host && h.electHost(room) && room.Host != "" {
+		h.notifyRoom(room, "", presence(room.Code, EventHostChanged, room.Host))
+	}
+}
+
+// electHost makes the longest-standing member of room, here or on another
+// instance, its host and reports whether that changed. Every instance knows
+// the same join times, so they all settle on the same host. Callers must
+// hold the room's lock.
+func (h *Hub) electHost(room *Room) bool {
+	host, since := "", time.Time{}
+	consider := func(name string, joined time.Time) {
+		if host == "" || joined.Before(since) || (joined.Equal(since) && name < host) {
+			host, since = name, joined
+		}
+	}
+	for name, p := range room.Peers {
+		consider(name, p.Joined)
+	}
+	h.remoteMu.Lock()
+	for name, rp := range h.remote[room.Code] {
+		consider(name, rp.joined)
+	}
+	h.remoteMu.Unlock()
+	changed := host != room.Host
+	room.Host = host
+	return changed
+}
+
+// retire keeps whatever was queued last for p so its next poll can deliver
+// it, for as long as a peer may go without polling, and releases any
+// transport still parked for it. Callers must hold the room's lock.
+func (h *Hub) retire(p *Peer) {
+	h.waitMu.Lock()
+	defer h.waitMu.Unlock()
+	if len(p.Queue) > 0 {
+		h.final[p.Token] = farewell{msgs: p.messages(), expires: time.Now().Add(h.cfg.PeerTimeout)}
+	}
+	if w := h.waiters[p.Token]; w != nil {
+		w.nudge()
+	}
+}
+
+// takeFinal hands over what the removed peer owning token was left with,
+// once
+func (h *Hub) takeFinal(token string) []SignalMessage {
+	h.waitMu.Lock()
+	defer h.waitMu.Unlock()
+	f, ok := h.final[token]
+	delete(h.final, token)
+	if !ok || time.Now().After(f.expires) {
+		return nil
+	}
+	return f.msgs
+}
+
+// expireFinal forgets the messages of removed peers that never came back
+// for them
+func (h *Hub) expireFinal(now time.Time) {
+	h.waitMu.Lock()
+	defer h.waitMu.Unlock()
+	for token, f := range h.final {
+		if now.After(f.expires) {
+			delete(h.final, token)
+		}
+	}
+}
+
+// notifyRoom queues a server-originated message for every member of room
+// except skip. Callers must hold the room's lock.
+func (h *Hub) notifyRoom(room *Room, skip string, msg SignalMessage) {
+	for name, p := range room.Peers {
+		if name == skip {
+			continue
+		}
+		p.notify(msg, h.cfg.Limits)
+		h.wake(p.Token)
+	}
+}
+
+// wake nudges a parked long-poll or WebSocket writer without blocking
+func (h *Hub) wake(token string) {
+	h.waitMu.Lock()
+	defer h.waitMu.Unlock()
+	if w := h.waiters[token]; w != nil {
+		w.nudge()
+	}
+}
+
+// nudge signals w without blocking; a pending signal is enough
+func (w *waiter) nudge() {
+	select {
+	case w.ch <- struct{}{}:
+	default:
+	}
+}
+
+// park registers a transport waiting on token and returns its wake-up channel
+func (h *Hub) park(token string) <-chan struct{} {
+	h.waitMu.Lock()
+	defer h.waitMu.Unlock()
+	w := h.waiters[token]
+	if w == nil {
+		w = &waiter{ch: make(chan struct{}, 1)}
+		h.waiters[token] = w
+	}
+	w.n++
+	return w.ch
+}
+
+// unpark undoes park, dropping the wake-up state once nobody waits on token
+func (h *Hub) unpark(token string) {
+	h.waitMu.Lock()
+	defer h.waitMu.Unlock()
+	w := h.waiters[token]
+	if w == nil {
+		return
+	}
+	w.n--
+	if w.n <= 0 {
+		delete(h.waiters, token)
+	}
+}
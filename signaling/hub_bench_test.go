@@ -0,0 +1,157 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkSignal measures Signal and Poll throughput while thousands of
+// other peers sit parked in long polls. Every parallel worker owns a room of
+// two peers and delivers one message per iteration: a Signal from one peer
+// and the Poll that collects it on the other.
+//
+// The serialized variants also push every Signal and Poll through one
+// mutex. That is not the pre-sharding code, which lived in main.go and is
+// gone; it only shows what a hub-wide lock around this code path costs.
+// With GOMAXPROCS=1 the two come out the same, since nothing runs in
+// parallel for the lock to stop; the gap opens with more CPUs:
+//
+//	go test ./signaling -run '^$' -bench Signal -cpu 1,4,16
+//
+// The slow-broker variants publish through a Broker that takes a
+// millisecond per envelope while another room sees a join and a leave every
+// millisecond, as with a distant Redis. Signal never waits on those
+// publishes, so it should cost about what it does in the plain run plus
+// the CPU the churn itself takes, not the broker's latency.
+func BenchmarkSignal(b *testing.B) {
+	for _, s := range testStores {
+		for _, parked := range []int{0, 5000} {
+			for _, v := range []struct {
+				name       string
+				serialized bool
+				slow       bool
+			}{{"", false, false}, {"/serialized", true, false}, {"/slow-broker", false, true}} {
+				b.Run(s.name+"/parked="+strconv.Itoa(parked)+v.name, func(b *testing.B) {
+					var broker Broker = NewLocalBroker()
+					if v.slow {
+						broker = slowBroker{broker}
+					}
+					h, err := NewHub(s.open(b), broker, benchConfig(b), log.New(io.Discard, "", 0))
+					if err != nil {
+						b.Fatal(err)
+					}
+					benchSignal(b, h, parked, v.serialized, v.slow)
+				})
+			}
+		}
+	}
+}
+
+// benchConfig is testConfig with rooms of two and room for a backlog
+func benchConfig(b *testing.B) Config {
+	cfg := testConfig(b)
+	cfg.MaxPeers = 2
+	cfg.Limits.MaxQueueLen = 256
+	return cfg
+}
+
+// slowBroker is a Broker that takes a millisecond to publish anything
+type slowBroker struct{ Broker }
+
+func (s slowBroker) Publish(env Envelope) error {
+	time.Sleep(time.Millisecond)
+	return s.Broker.Publish(env)
+}
+
+func benchSignal(b *testing.B, h *Hub, parked int, serialized, churn bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	for i := range parked {
+		idle := mustJoin(b, h, "PARK"+strconv.Itoa(i), "idle")
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				if _, err := h.Poll(ctx, idle.Peer.Token, PollOptions{Wait: time.Minute}); err != nil {
+					return
+				}
+			}
+		})
+	}
+	for {
+		h.waitMu.Lock()
+		n := len(h.waiters)
+		h.waitMu.Unlock()
+		if n == parked {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if churn {
+		// every join and leave has an envelope to publish
+		wg.Go(func() {
+			tick := time.NewTicker(time.Millisecond)
+			defer tick.Stop()
+			for ctx.Err() == nil {
+				<-tick.C
+				m, err := h.Join("CHURN", "guest", JoinOptions{})
+				if err != nil {
+					return
+				}
+				_ = h.Leave(m.Peer.Token)
+			}
+		})
+	}
+
+	var (
+		rooms  atomic.Int64
+		global sync.Mutex
+	)
+	serialize := func() func() {
+		if !serialized {
+			return func() {}
+		}
+		global.Lock()
+		return global.Unlock
+	}
+	msg := SignalMessage{To: "b", Type: "ping", Data: json.RawMessage(`{}`)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		code := "BENCH" + strconv.FormatInt(rooms.Add(1), 10)
+		a, err := h.Join(code, "a", JoinOptions{})
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		bob, err := h.Join(code, "b", JoinOptions{})
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		for pb.Next() {
+			unlock := serialize()
+			err := h.Signal(a.Peer.Token, msg)
+			unlock()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			unlock = serialize()
+			msgs, err := h.Poll(ctx, bob.Peer.Token, PollOptions{})
+			unlock()
+			if err != nil || len(msgs) != 1 {
+				b.Errorf("poll got %d messages: %v", len(msgs), err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+}
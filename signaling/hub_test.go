@@ -0,0 +1,899 @@
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"galacticApps/middleware"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStores are the Store implementations every Hub test runs against
+var testStores = []struct {
+	name string
+	open func(t testing.TB) Store
+}{
+	{"memory", func(t testing.TB) Store { return NewMemoryStore() }},
+	{"sqlite", func(t testing.TB) Store {
+		s, err := OpenSQLiteStore(t.TempDir() + "/db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}},
+}
+
+// testConfig is ConfigFromEnv with small limits and a scratch drop directory
+func testConfig(t testing.TB) Config {
+	cfg := ConfigFromEnv()
+	cfg.Drop.Dir = t.TempDir()
+	cfg.PeerTimeout = time.Minute
+	cfg.Limits.MaxMessageBytes = 1024
+	cfg.Limits.MaxQueueLen = 8
+	return cfg
+}
+
+func newTestHub(t testing.TB, store Store, cfg Config) *Hub {
+	t.Helper()
+	h, err := NewHub(store, NewLocalBroker(), cfg, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// forEachStore runs fn as a subtest against a fresh Hub on every Store
+func forEachStore(t *testing.T, fn func(t *testing.T, h *Hub)) {
+	for _, s := range testStores {
+		t.Run(s.name, func(t *testing.T) {
+			fn(t, newTestHub(t, s.open(t), testConfig(t)))
+		})
+	}
+}
+
+func mustJoin(t testing.TB, h *Hub, code, name string) *Membership {
+	t.Helper()
+	m, err := h.Join(code, name, JoinOptions{})
+	if err != nil {
+		t.Fatalf("join %s as %s: %v", code, name, err)
+	}
+	return m
+}
+
+// poll returns what is queued for token without waiting
+func poll(t *testing.T, h *Hub, token string) []SignalMessage {
+	t.Helper()
+	msgs, err := h.Poll(context.Background(), token, PollOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+// types lists the Type of each message
+func types(msgs []SignalMessage) []string {
+	out := []string{}
+	for _, m := range msgs {
+		out = append(out, m.Type)
+	}
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestJoin(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		host := mustJoin(t, h, "ROOM", "alice")
+		if host.Host != "alice" || len(host.Others) != 0 {
+			t.Fatalf("first member: host %q, others %v", host.Host, host.Others)
+		}
+
+		tests := []struct {
+			name     string
+			code     string
+			join     string
+			opts     JoinOptions
+			wantName string
+			wantErr  error
+		}{
+			{"second member", "ROOM", "bob", JoinOptions{}, "bob", nil},
+			{"taken name", "ROOM", "alice", JoinOptions{}, "", ErrNameTaken},
+			{"taken name with suffix", "ROOM", "alice", JoinOptions{OnConflict: ConflictSuffix}, "alice-2", nil},
+			{"resume with token", "ROOM", "alice", JoinOptions{Token: host.Peer.Token}, "alice", nil},
+			{"code typed by hand", "ro-om ", "carol", JoinOptions{}, "carol", nil},
+			{"device room", deviceRoomPrefix + "x", "mallory", JoinOptions{}, "", ErrNotPaired},
+		}
+		for _, tt := range tests {
+			m, err := h.Join(tt.code, tt.join, tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("%s: err %v, want %v", tt.name, err, tt.wantErr)
+			}
+			if err == nil && (m.Peer.Name != tt.wantName || m.Host != "alice") {
+				t.Fatalf("%s: joined as %q with host %q", tt.name, m.Peer.Name, m.Host)
+			}
+		}
+
+		resumed, _ := h.Join("ROOM", "alice", JoinOptions{Token: host.Peer.Token})
+		if resumed.Peer.Token != host.Peer.Token {
+			t.Fatal("resume issued a new token")
+		}
+		if got := poll(t, h, host.Peer.Token); !equal(types(got), []string{EventPeerJoined, EventPeerJoined, EventPeerJoined}) {
+			t.Fatalf("host was told %v", types(got))
+		}
+	})
+}
+
+func TestJoinRoomFull(t *testing.T) {
+	for _, s := range testStores {
+		t.Run(s.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.MaxPeers = 2
+			h := newTestHub(t, s.open(t), cfg)
+			mustJoin(t, h, "ROOM", "a")
+			mustJoin(t, h, "ROOM", "b")
+			if _, err := h.Join("ROOM", "c", JoinOptions{}); !errors.Is(err, ErrRoomFull) {
+				t.Fatalf("third join: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignal(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		a := mustJoin(t, h, "ROOM", "a")
+		b := mustJoin(t, h, "ROOM", "b")
+		c := mustJoin(t, h, "ROOM", "c")
+		for _, m := range []*Membership{a, b, c} {
+			poll(t, h, m.Peer.Token)
+		}
+
+		tests := []struct {
+			name    string
+			token   string
+			msg     SignalMessage
+			wantErr error
+			// what each of a, b and c has queued afterwards
+			want [3][]string
+		}{
+			{"direct", a.Peer.Token, SignalMessage{To: "b", Type: "offer"}, nil,
+				[3][]string{{}, {"offer"}, {}}},
+			{"broadcast", a.Peer.Token, SignalMessage{Type: "hello"}, nil,
+				[3][]string{{}, {"hello"}, {"hello"}}},
+			{"spoofed from", b.Peer.Token, SignalMessage{From: "c", Code: "OTHER", To: "a", Type: "answer"}, nil,
+				[3][]string{{"answer"}, {}, {}}},
+			{"bad token", "nope", SignalMessage{Type: "x"}, ErrUnauthorized,
+				[3][]string{{}, {}, {}}},
+			{"too large", a.Peer.Token, SignalMessage{Type: "x", Data: json.RawMessage(`"` + string(make([]byte, 2048)) + `"`)},
+				ErrMessageTooLarge, [3][]string{{}, {}, {}}},
+		}
+		for _, tt := range tests {
+			err := h.Signal(tt.token, tt.msg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("%s: err %v, want %v", tt.name, err, tt.wantErr)
+			}
+			for i, m := range []*Membership{a, b, c} {
+				got := poll(t, h, m.Peer.Token)
+				if !equal(types(got), tt.want[i]) {
+					t.Fatalf("%s: %s got %v, want %v", tt.name, m.Peer.Name, types(got), tt.want[i])
+				}
+				for _, msg := range got {
+					if msg.Code != "ROOM" || msg.From == m.Peer.Name || msg.From == "" {
+						t.Fatalf("%s: %s got %+v", tt.name, m.Peer.Name, msg)
+					}
+				}
+			}
+		}
+	})
+}
+
+func TestSignalQueueFullChangesNothing(t *testing.T) {
+	for _, s := range testStores {
+		for _, dropOldest := range []bool{false, true} {
+			t.Run(s.name+"/dropOldest="+strconv.FormatBool(dropOldest), func(t *testing.T) {
+				cfg := testConfig(t)
+				cfg.Limits.MaxQueueLen = 2
+				cfg.Limits.DropOldest = dropOldest
+				h := newTestHub(t, s.open(t), cfg)
+				a := mustJoin(t, h, "ROOM", "a")
+				b := mustJoin(t, h, "ROOM", "b")
+				poll(t, h, a.Peer.Token)
+				// a's queue is full, b's is empty
+				for range 2 {
+					if err := h.Signal(b.Peer.Token, SignalMessage{To: "a", Type: "x"}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				err := h.Signal(b.Peer.Token, SignalMessage{To: "a", Type: "y"})
+				if dropOldest {
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := types(poll(t, h, a.Peer.Token)); !equal(got, []string{"x", "y"}) {
+						t.Fatalf("after drop-oldest a got %v", got)
+					}
+					return
+				}
+				if !errors.Is(err, ErrQueueFull) {
+					t.Fatalf("err %v, want ErrQueueFull", err)
+				}
+				if got := types(poll(t, h, a.Peer.Token)); !equal(got, []string{"x", "x"}) {
+					t.Fatalf("a's queue changed to %v", got)
+				}
+			})
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		a := mustJoin(t, h, "ROOM", "a")
+		b := mustJoin(t, h, "ROOM", "b")
+		poll(t, h, a.Peer.Token)
+		ctx := context.Background()
+
+		// acknowledged polls replay until acked
+		h.Signal(b.Peer.Token, SignalMessage{To: "a", Type: "one"})
+		h.Signal(b.Peer.Token, SignalMessage{To: "a", Type: "two"})
+		zero := uint64(0)
+		first, err := h.Poll(ctx, a.Peer.Token, PollOptions{Ack: &zero})
+		if err != nil || !equal(types(first), []string{"one", "two"}) {
+			t.Fatalf("first poll %v, %v", types(first), err)
+		}
+		again, _ := h.Poll(ctx, a.Peer.Token, PollOptions{Ack: &zero})
+		if !equal(types(again), []string{"one", "two"}) {
+			t.Fatalf("unacked poll %v", types(again))
+		}
+		ack := first[0].Seq
+		rest, _ := h.Poll(ctx, a.Peer.Token, PollOptions{Ack: &ack})
+		if !equal(types(rest), []string{"two"}) {
+			t.Fatalf("after ack %v", types(rest))
+		}
+		ack = rest[0].Seq
+		if done, _ := h.Poll(ctx, a.Peer.Token, PollOptions{Ack: &ack}); len(done) != 0 {
+			t.Fatalf("after final ack %v", types(done))
+		}
+
+		// a long poll times out empty and wakes up for a signal
+		start := time.Now()
+		if msgs, _ := h.Poll(ctx, a.Peer.Token, PollOptions{Wait: 50 * time.Millisecond}); len(msgs) != 0 || time.Since(start) < 50*time.Millisecond {
+			t.Fatalf("idle long poll returned %v after %v", types(msgs), time.Since(start))
+		}
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			h.Signal(b.Peer.Token, SignalMessage{To: "a", Type: "late"})
+		}()
+		msgs, _ := h.Poll(ctx, a.Peer.Token, PollOptions{Wait: 5 * time.Second})
+		if !equal(types(msgs), []string{"late"}) {
+			t.Fatalf("woken poll %v", types(msgs))
+		}
+
+		if _, err := h.Poll(ctx, "nope", PollOptions{}); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("bad token: %v", err)
+		}
+	})
+}
+
+func TestLeave(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		a := mustJoin(t, h, "ROOM", "a")
+		b := mustJoin(t, h, "ROOM", "b")
+		c := mustJoin(t, h, "ROOM", "c")
+		poll(t, h, b.Peer.Token)
+		poll(t, h, c.Peer.Token)
+
+		tests := []struct {
+			name    string
+			token   string
+			wantErr error
+			// what the member still watching is told
+			watcher string
+			want    []string
+		}{
+			{"host leaves", a.Peer.Token, nil, b.Peer.Token, []string{EventPeerLeft, EventHostChanged}},
+			{"twice", a.Peer.Token, ErrUnauthorized, b.Peer.Token, []string{}},
+			{"member leaves", c.Peer.Token, nil, b.Peer.Token, []string{EventPeerLeft}},
+		}
+		for _, tt := range tests {
+			if err := h.Leave(tt.token); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("%s: err %v, want %v", tt.name, err, tt.wantErr)
+			}
+			if got := types(poll(t, h, tt.watcher)); !equal(got, tt.want) {
+				t.Fatalf("%s: watcher got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+		if err := h.Signal(a.Peer.Token, SignalMessage{Type: "x"}); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("signal after leave: %v", err)
+		}
+
+		// the last one out deletes the room
+		if err := h.Leave(b.Peer.Token); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.store.LoadRoom("ROOM"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("empty room still stored: %v", err)
+		}
+	})
+}
+
+func TestReap(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		mustJoin(t, h, "ROOM", "stale")
+		live := mustJoin(t, h, "ROOM", "live")
+		mustJoin(t, h, "GONE", "alone")
+		for _, code := range []string{"ROOM", "GONE"} {
+			room, err := h.store.LoadRoom(code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range room.Peers {
+				if p.Name != "live" {
+					p.LastSeen = time.Now().Add(-2 * h.cfg.PeerTimeout)
+				}
+			}
+			if err := h.store.SaveRoom(room); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		n, err := h.Reap()
+		if err != nil || n != 2 {
+			t.Fatalf("reaped %d, %v", n, err)
+		}
+		got := types(poll(t, h, live.Peer.Token))
+		if !equal(got, []string{EventPeerTimedOut, EventHostChanged}) {
+			t.Fatalf("survivor got %v", got)
+		}
+		if _, err := h.store.LoadRoom("GONE"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("abandoned room still stored: %v", err)
+		}
+		if n, _ := h.Reap(); n != 0 {
+			t.Fatalf("second reap took %d", n)
+		}
+	})
+}
+
+func TestHostAcrossInstances(t *testing.T) {
+	for _, s := range testStores {
+		t.Run(s.name, func(t *testing.T) {
+			broker := NewLocalBroker()
+			hub := func() *Hub {
+				h, err := NewHub(s.open(t), broker, testConfig(t), log.New(io.Discard, "", 0))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return h
+			}
+			a, b := hub(), hub()
+
+			alice := mustJoin(t, a, "ROOM", "alice")
+			a.settle()
+			bob := mustJoin(t, b, "ROOM", "bob")
+			carol := mustJoin(t, b, "ROOM", "carol")
+			if bob.Host != "alice" || carol.Host != "alice" {
+				t.Fatalf("joined on the other instance with host %q and %q", bob.Host, carol.Host)
+			}
+			if err := b.Kick(bob.Peer.Token, "carol"); !errors.Is(err, ErrNotHost) {
+				t.Fatalf("kick by a non-host: %v", err)
+			}
+			b.settle()
+			a.settle()
+			poll(t, b, bob.Peer.Token)
+			poll(t, b, carol.Peer.Token)
+
+			if err := a.Leave(alice.Peer.Token); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "host-changed on the other instance", func() bool {
+				return equal(types(poll(t, b, carol.Peer.Token)), []string{EventPeerLeft, EventHostChanged})
+			})
+			if err := b.Kick(bob.Peer.Token, "carol"); err != nil {
+				t.Fatalf("kick by the new host: %v", err)
+			}
+		})
+	}
+}
+
+func TestRegisterDevice(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		register := func(token, code string) (*Device, []*Device, error) {
+			pub, priv, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			challenge, _, err := h.Challenge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig := ed25519.Sign(priv, deviceMessage("register", challenge, code))
+			return h.RegisterDevice(token, pub, "", challenge, sig)
+		}
+
+		plain := mustJoin(t, h, "ROOM", "alice")
+		if _, _, err := register(plain.Peer.Token, "ROOM"); !errors.Is(err, ErrNotPairingRoom) {
+			t.Fatalf("registered in a plain room: %v", err)
+		}
+
+		phone, _, err := h.Pair("phone", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		watch := mustJoin(t, h, phone.Code, "watch")
+		if _, paired, err := register(phone.Token, phone.Code); err != nil || len(paired) != 0 {
+			t.Fatalf("first device paired with %d: %v", len(paired), err)
+		}
+		if _, paired, err := register(watch.Peer.Token, phone.Code); err != nil || len(paired) != 1 {
+			t.Fatalf("second device paired with %d: %v", len(paired), err)
+		}
+	})
+}
+
+func TestReadDropAfterDownload(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		alice := mustJoin(t, h, "ROOM", "alice")
+		bob := mustJoin(t, h, "ROOM", "bob")
+		carol := mustJoin(t, h, "ROOM", "carol")
+		d, err := h.CreateDrop(alice.Peer.Token, "note.txt", "text/plain", 5, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.WriteDrop(alice.Peer.Token, d.ID, 0, strings.NewReader("hello")); err != nil {
+			t.Fatal(err)
+		}
+		read := func(token string, offset int64) (string, error) {
+			var buf bytes.Buffer
+			err := h.ReadDrop(token, d.ID, offset, &buf, func(Drop) {})
+			return buf.String(), err
+		}
+
+		if got, err := read(bob.Peer.Token, 0); err != nil || got != "hello" {
+			t.Fatalf("download: %q, %v", got, err)
+		}
+		tests := []struct {
+			name    string
+			token   string
+			offset  int64
+			want    string
+			wantErr error
+		}{
+			{"downloader resumes", bob.Peer.Token, 1, "ello", nil},
+			{"downloader starts over", bob.Peer.Token, 0, "", ErrDropNotFound},
+			{"someone else resumes", carol.Peer.Token, 1, "", ErrDropNotFound},
+			{"someone else downloads", carol.Peer.Token, 0, "", ErrDropNotFound},
+		}
+		for _, tt := range tests {
+			got, err := read(tt.token, tt.offset)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Fatalf("%s: %q, %v", tt.name, got, err)
+			}
+		}
+	})
+}
+
+func TestHeldMessages(t *testing.T) {
+	offer := SignalMessage{To: "bob", Type: "offer", Data: json.RawMessage(`{"sdp":"x"}`)}
+	heldFor := func(t *testing.T, h *Hub, name string) int {
+		t.Helper()
+		room, err := h.store.LoadRoom("ROOM")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(room.Held[name])
+	}
+	t.Run("delivered on join", func(t *testing.T) {
+		forEachStore(t, func(t *testing.T, h *Hub) {
+			alice, err := h.Create("ROOM", "alice", JoinOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Signal(alice.Peer.Token, offer); err != nil {
+				t.Fatal(err)
+			}
+			if n := heldFor(t, h, "bob"); n != 1 {
+				t.Fatalf("%d messages held for bob, want 1", n)
+			}
+			bob := mustJoin(t, h, "ROOM", "bob")
+			var got []SignalMessage
+			for _, m := range poll(t, h, bob.Peer.Token) {
+				if m.Type == "offer" {
+					got = append(got, m)
+				}
+			}
+			if len(got) != 1 || got[0].From != "alice" || string(got[0].Data) != `{"sdp":"x"}` {
+				t.Fatalf("bob got %+v", got)
+			}
+			if n := heldFor(t, h, "bob"); n != 0 {
+				t.Errorf("%d messages still held after delivery", n)
+			}
+		})
+	})
+	t.Run("expire after the TTL", func(t *testing.T) {
+		forEachStore(t, func(t *testing.T, h *Hub) {
+			h.cfg.HoldTTL = 10 * time.Millisecond
+			alice, err := h.Create("ROOM", "alice", JoinOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Signal(alice.Peer.Token, offer); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(20 * time.Millisecond)
+			if _, err := h.Reap(); err != nil {
+				t.Fatal(err)
+			}
+			if n := heldFor(t, h, "bob"); n != 0 {
+				t.Fatalf("%d messages held past the TTL", n)
+			}
+			bob := mustJoin(t, h, "ROOM", "bob")
+			if got := types(poll(t, h, bob.Peer.Token)); slices.Contains(got, "offer") {
+				t.Errorf("bob got an expired message: %v", got)
+			}
+		})
+	})
+	t.Run("keep an empty room", func(t *testing.T) {
+		forEachStore(t, func(t *testing.T, h *Hub) {
+			alice, err := h.Create("ROOM", "alice", JoinOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Signal(alice.Peer.Token, offer); err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Leave(alice.Peer.Token); err != nil {
+				t.Fatal(err)
+			}
+			room, err := h.store.LoadRoom("ROOM")
+			if err != nil {
+				t.Fatalf("room with held messages dropped when its last member left: %v", err)
+			}
+			if len(room.Peers) != 0 || len(room.Held["bob"]) != 1 || room.Idle.IsZero() {
+				t.Fatalf("kept room has %d peers, %d held, idle %v", len(room.Peers), len(room.Held["bob"]), room.Idle)
+			}
+			bob := mustJoin(t, h, "ROOM", "bob")
+			if got := types(poll(t, h, bob.Peer.Token)); !slices.Contains(got, "offer") {
+				t.Errorf("bob got %v, want the held offer", got)
+			}
+
+			// once nothing is held any more an empty room goes
+			if err := h.Leave(bob.Peer.Token); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := h.store.LoadRoom("ROOM"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("empty room with nothing held still stored: %v", err)
+			}
+		})
+	})
+}
+
+func TestRelay(t *testing.T) {
+	frame := func(to string) SignalMessage {
+		return SignalMessage{To: to, Type: TypeRelay, Data: json.RawMessage(`"` + strings.Repeat("x", 100) + `"`)}
+	}
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		// room for two frames and next to no refill
+		h.cfg.Limits.RelayBurstBytes = 2 * msgSize(SignalMessage{Code: "ROOM", From: "alice", To: "bob", Type: TypeRelay, Data: frame("").Data})
+		h.cfg.Limits.RelayBytesPerSec = 1
+		alice := mustJoin(t, h, "ROOM", "alice")
+		bob := mustJoin(t, h, "ROOM", "bob")
+		poll(t, h, alice.Peer.Token)
+
+		tests := []struct {
+			name string
+			msg  SignalMessage
+			want error
+		}{
+			{"to a member", frame("bob"), nil},
+			{"to everyone", frame(""), ErrTargetNotFound},
+			{"to itself", frame("alice"), ErrTargetNotFound},
+			{"to someone yet to join", frame("carol"), ErrTargetNotFound},
+			{"within the burst", frame("bob"), nil},
+			{"past the burst", frame("bob"), ErrRelayLimit},
+		}
+		for _, tt := range tests {
+			if err := h.Signal(alice.Peer.Token, tt.msg); !errors.Is(err, tt.want) {
+				t.Fatalf("%s: %v, want %v", tt.name, err, tt.want)
+			}
+		}
+		if got := types(poll(t, h, bob.Peer.Token)); !equal(got, []string{TypeRelay, TypeRelay}) {
+			t.Errorf("bob got %v, want the two frames within the burst", got)
+		}
+		room, err := h.store.LoadRoom("ROOM")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(room.Held) != 0 {
+			t.Errorf("relay frames held for %v", room.Held)
+		}
+
+		// the limit is per room
+		carol := mustJoin(t, h, "OTHER", "carol")
+		mustJoin(t, h, "OTHER", "bob")
+		if err := h.Signal(carol.Peer.Token, frame("bob")); err != nil {
+			t.Errorf("another room's relay: %v", err)
+		}
+	})
+}
+
+func TestDropUploadErrors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		alice := mustJoin(t, h, "ROOM", "alice")
+		mustJoin(t, h, "ROOM", "bob")
+		d, err := h.CreateDrop(alice.Peer.Token, "big.bin", "", 2*maxDropChunk, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch := func(offset int64, body []byte, sized bool) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodPatch, "/webrtc/drops/"+d.ID+"?offset="+strconv.FormatInt(offset, 10), bytes.NewReader(body))
+			if !sized {
+				// as a chunked upload would arrive
+				r.Body, r.ContentLength = io.NopCloser(struct{ io.Reader }{bytes.NewReader(body)}), -1
+			}
+			r.Header.Set("X-Peer-Token", alice.Peer.Token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			return rec
+		}
+		stored := func() int64 {
+			t.Helper()
+			status, err := h.DropStatus(alice.Peer.Token, d.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return status.Offset
+		}
+
+		tests := []struct {
+			name   string
+			offset int64
+			size   int
+			sized  bool
+			status int
+			want   int64 // stored offset afterwards
+		}{
+			{"ahead of the upload", 1, 10, true, http.StatusRequestedRangeNotSatisfiable, 0},
+			{"chunk over the cap", 0, maxDropChunk + 1, true, http.StatusRequestEntityTooLarge, 0},
+			{"unsized chunk over the cap", 0, maxDropChunk + 1, false, http.StatusRequestEntityTooLarge, 0},
+			{"full chunk", 0, maxDropChunk, false, http.StatusOK, maxDropChunk},
+			{"behind the upload", 0, 10, true, http.StatusRequestedRangeNotSatisfiable, maxDropChunk},
+			{"past the announced size", maxDropChunk, maxDropChunk + 1, false, http.StatusRequestEntityTooLarge, maxDropChunk},
+		}
+		for _, tt := range tests {
+			rec := patch(tt.offset, make([]byte, tt.size), tt.sized)
+			if rec.Code != tt.status {
+				t.Fatalf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+			}
+			if got := stored(); got != tt.want {
+				t.Fatalf("%s: stored offset %d, want %d", tt.name, got, tt.want)
+			}
+			if tt.status == http.StatusRequestedRangeNotSatisfiable {
+				if got := rec.Header().Get("Upload-Offset"); got != strconv.FormatInt(tt.want, 10) {
+					t.Errorf("%s: Upload-Offset %q, want %d", tt.name, got, tt.want)
+				}
+			}
+		}
+		if info, err := os.Stat(filepath.Join(h.cfg.Drop.Dir, d.ID+".drop")); err != nil || info.Size() != maxDropChunk {
+			t.Errorf("drop file holds more than was accepted: %v, %v", info, err)
+		}
+	})
+}
+
+func TestPollAfterRemoval(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		// nobody is parked: the client polls on an interval
+		alice := mustJoin(t, h, "ROOM", "alice")
+		if err := h.CloseAll(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := h.Poll(context.Background(), alice.Peer.Token, PollOptions{})
+		if err != nil || !equal(types(got), []string{EventRoomClosed}) {
+			t.Fatalf("next poll got %v, %v", types(got), err)
+		}
+		if _, err := h.Poll(context.Background(), alice.Peer.Token, PollOptions{}); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("poll after that: %v", err)
+		}
+	})
+}
+
+func TestKickAndCloseWithoutParkedPoll(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		host := mustJoin(t, h, "ROOM", "alice")
+		bob := mustJoin(t, h, "ROOM", "bob")
+		carol := mustJoin(t, h, "ROOM", "carol")
+		poll(t, h, bob.Peer.Token)
+		poll(t, h, carol.Peer.Token)
+
+		if err := h.Kick(host.Peer.Token, "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if got := types(poll(t, h, bob.Peer.Token)); !equal(got, []string{EventPeerKicked}) {
+			t.Fatalf("kicked member got %v", got)
+		}
+
+		if err := h.CloseRoom(host.Peer.Token); err != nil {
+			t.Fatal(err)
+		}
+		if got := types(poll(t, h, carol.Peer.Token)); !equal(got, []string{EventPeerKicked, EventRoomClosed}) {
+			t.Fatalf("member of the closed room got %v", got)
+		}
+		if _, err := h.Poll(context.Background(), bob.Peer.Token, PollOptions{}); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("second poll after the kick: %v", err)
+		}
+	})
+}
+
+func TestState(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		h.cfg.Limits.MaxStateBytes = 32
+		alice := mustJoin(t, h, "ROOM", "alice")
+		bob := mustJoin(t, h, "ROOM", "bob")
+		poll(t, h, alice.Peer.Token)
+		zero, one := uint64(0), uint64(1)
+
+		tests := []struct {
+			name        string
+			key         string
+			value       string
+			ifVersion   *uint64
+			wantVersion uint64
+			wantErr     error
+		}{
+			{"create", "toot", `"1"`, &zero, 1, nil},
+			{"create again", "toot", `"2"`, &zero, 0, ErrVersionConflict},
+			{"compare and set", "toot", `"2"`, &one, 2, nil},
+			{"stale version", "toot", `"3"`, &one, 0, ErrVersionConflict},
+			{"overwrite", "scroll", `120`, nil, 3, nil},
+			{"too big", "draft", `"` + strings.Repeat("x", 32) + `"`, nil, 0, ErrStateFull},
+			{"empty key", "", `1`, nil, 0, ErrInvalidKey},
+			{"delete", "scroll", `null`, nil, 4, nil},
+			{"delete missing", "scroll", `null`, nil, 4, nil},
+		}
+		for _, tt := range tests {
+			v, err := h.SetState(alice.Peer.Token, tt.key, json.RawMessage(tt.value), tt.ifVersion)
+			if !errors.Is(err, tt.wantErr) || v != tt.wantVersion {
+				t.Fatalf("%s: version %d, %v", tt.name, v, err)
+			}
+		}
+
+		doc, err := h.State(bob.Peer.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Version != 4 || len(doc.Entries) != 1 || string(doc.Entries["toot"].Value) != `"2"` || doc.Entries["toot"].By != "alice" {
+			t.Fatalf("document is %+v", doc)
+		}
+		// one notification per key, the latest; nothing back to the writer
+		if got := types(poll(t, h, bob.Peer.Token)); !equal(got, []string{EventStateChanged, EventStateChanged}) {
+			t.Fatalf("bob was told %v", got)
+		}
+		if got := poll(t, h, alice.Peer.Token); len(got) != 0 {
+			t.Fatalf("alice was told %v", types(got))
+		}
+	})
+}
+
+func TestStateOutlivesRoom(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		alice := mustJoin(t, h, "ROOM", "alice")
+		if _, err := h.SetState(alice.Peer.Token, "toot", json.RawMessage(`"42"`), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Leave(alice.Peer.Token); err != nil {
+			t.Fatal(err)
+		}
+
+		bob := mustJoin(t, h, "ROOM", "bob")
+		doc, err := h.State(bob.Peer.Token)
+		if err != nil || string(doc.Entries["toot"].Value) != `"42"` {
+			t.Fatalf("after rejoining: %+v, %v", doc, err)
+		}
+		if err := h.Leave(bob.Peer.Token); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.Reap(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.store.LoadRoom("ROOM"); err != nil {
+			t.Fatalf("room dropped before its state expired: %v", err)
+		}
+
+		h.cfg.StateTTL = time.Nanosecond
+		if _, err := h.Reap(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.store.LoadRoom("ROOM"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("room kept after its state expired: %v", err)
+		}
+	})
+}
+
+func TestStateAcrossInstances(t *testing.T) {
+	for _, s := range testStores {
+		t.Run(s.name, func(t *testing.T) {
+			broker := NewLocalBroker()
+			hub := func() *Hub {
+				h, err := NewHub(s.open(t), broker, testConfig(t), log.New(io.Discard, "", 0))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return h
+			}
+			a, b := hub(), hub()
+
+			// alice leaves a place on A and goes
+			alice := mustJoin(t, a, "ROOM", "alice")
+			if _, err := a.SetState(alice.Peer.Token, "toot", json.RawMessage(`"42"`), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Leave(alice.Peer.Token); err != nil {
+				t.Fatal(err)
+			}
+			a.settle()
+
+			// bob picks it up on B, and what bob writes reaches A
+			bob := mustJoin(t, b, "ROOM", "bob")
+			waitFor(t, "the state on the other instance", func() bool {
+				doc, err := b.State(bob.Peer.Token)
+				return err == nil && string(doc.Entries["toot"].Value) == `"42"`
+			})
+			if got := types(poll(t, b, bob.Peer.Token)); !equal(got, []string{EventStateChanged}) {
+				t.Fatalf("bob was told %v", got)
+			}
+			if _, err := b.SetState(bob.Peer.Token, "toot", json.RawMessage(`"43"`), nil); err != nil {
+				t.Fatal(err)
+			}
+			carol := mustJoin(t, a, "ROOM", "carol")
+			waitFor(t, "the change back on the first instance", func() bool {
+				doc, err := a.State(carol.Peer.Token)
+				return err == nil && string(doc.Entries["toot"].Value) == `"43"`
+			})
+		})
+	}
+}
+
+func TestSameNetwork(t *testing.T) {
+	if err := middleware.SetTrustedProxies("203.0.113.9", nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { middleware.SetTrustedProxies("", nil) })
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"198.51.100.7", "198.51.100.7", true},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"198.51.100.7", "198.51.100.8", false},
+		{"", "", false},
+		{"127.0.0.1", "127.0.0.1", false},
+		{"::1", "::1", false},
+		{"10.1.2.3", "10.1.2.3", false},
+		{"192.168.0.2", "192.168.0.2", false},
+		{"203.0.113.9", "203.0.113.9", false}, // the proxy itself
+	}
+	for _, tt := range tests {
+		if got := sameNetwork(&Peer{IP: tt.a}, &Peer{IP: tt.b}); got != tt.want {
+			t.Errorf("sameNetwork(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package signaling
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ICEServer is one entry of an RTCConfiguration.iceServers list
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEServers returns the STUN/TURN servers for the peer owning token, led by
+// the embedded STUN responder (if any) on host, the name the client used to
+// reach this server. TURN entries carry credentials from turnCredential.
+func (h *Hub) ICEServers(token, host string) ([]ICEServer, time.Duration, error) {
+	_, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return nil, 0, err
+	}
+	unlock()
+
+	ice := h.cfg.ICE
+	servers := []ICEServer{}
+	if ice.LocalSTUNPort != 0 {
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		servers = append(servers, ICEServer{URLs: []string{"stun:" + net.JoinHostPort(host, strconv.Itoa(ice.LocalSTUNPort))}})
+	}
+	if len(ice.STUNURLs) > 0 {
+		servers = append(servers, ICEServer{URLs: ice.STUNURLs})
+	}
+	if len(ice.TURNURLs) > 0 && ice.TURNSecret != "" {
+		username, credential := turnCredential(ice.TURNSecret, p.Code, time.Now().Add(ice.TURNTTL))
+		servers = append(servers, ICEServer{URLs: ice.TURNURLs, Username: username, Credential: credential})
+	}
+	return servers, ice.TURNTTL, nil
+}
+
+// turnCredential issues TURN credentials for user valid until expires, per
+// the TURN REST API scheme that coturn implements with use-auth-secret: the
+// username is "<expiry unix time>:<user>" and the password is
+// base64(HMAC-SHA1(secret, username)).
+func turnCredential(secret, user string, expires time.Time) (username, credential string) {
+	username = strconv.FormatInt(expires.Unix(), 10) + ":" + user
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Hub) handleICEServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	servers, ttl, err := h.ICEServers(peerToken(r), r.Host)
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	// credentials are per caller and short-lived
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]any{"iceServers": servers, "ttl": int(ttl.Seconds())})
+}
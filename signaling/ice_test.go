@@ -0,0 +1,99 @@
+package signaling
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// turnAccepts checks TURN REST API credentials the way a TURN server with
+// use-auth-secret does at time now
+func turnAccepts(secret, username, credential string, now time.Time) bool {
+	expiry, _, ok := strings.Cut(username, ":")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.Unix() > unix {
+		return false
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(credential), []byte(want))
+}
+
+func TestTURNCredential(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	username, credential := turnCredential("north-wind", "ROOM", now.Add(time.Hour))
+	if username != "1792328400:ROOM" || credential != "v1tdVgcXQlHgK/06rp0TftR3/jY=" {
+		t.Fatalf("turnCredential = %q, %q", username, credential)
+	}
+
+	tests := []struct {
+		name                         string
+		secret, username, credential string
+		at                           time.Time
+		want                         bool
+	}{
+		{"fresh", "north-wind", username, credential, now, true},
+		{"at expiry", "north-wind", username, credential, now.Add(time.Hour), true},
+		{"expired", "north-wind", username, credential, now.Add(time.Hour + time.Second), false},
+		{"other secret", "south-wind", username, credential, now, false},
+		{"expiry pushed back", "north-wind", "1792332000:ROOM", credential, now, false},
+		{"other room", "north-wind", "1792328400:OTHER", credential, now, false},
+	}
+	for _, tt := range tests {
+		if got := turnAccepts(tt.secret, tt.username, tt.credential, tt.at); got != tt.want {
+			t.Errorf("%s: accepted = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestICEServers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, h *Hub) {
+		h.cfg.ICE = ICEConfig{
+			LocalSTUNPort: 3478,
+			STUNURLs:      []string{"stun:stun.example:3478"},
+			TURNURLs:      []string{"turn:turn.example:3478"},
+			TURNSecret:    "north-wind",
+			TURNTTL:       time.Hour,
+		}
+		m := mustJoin(t, h, "ROOM", "alice")
+		before := time.Now()
+		servers, ttl, err := h.ICEServers(m.Peer.Token, "nebulink.example:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl != time.Hour || len(servers) != 3 {
+			t.Fatalf("ttl %v, servers %+v", ttl, servers)
+		}
+		if got := servers[0].URLs; len(got) != 1 || got[0] != "stun:nebulink.example:3478" {
+			t.Errorf("embedded STUN server %v", got)
+		}
+		turn := servers[2]
+		if !strings.HasSuffix(turn.Username, ":ROOM") {
+			t.Errorf("TURN username %q does not name the room", turn.Username)
+		}
+		if !turnAccepts("north-wind", turn.Username, turn.Credential, before.Add(time.Hour-time.Second)) {
+			t.Error("TURN credentials rejected within their TTL")
+		}
+		if turnAccepts("north-wind", turn.Username, turn.Credential, time.Now().Add(time.Hour+2*time.Second)) {
+			t.Error("TURN credentials accepted past their TTL")
+		}
+
+		// no secret, no TURN
+		h.cfg.ICE.TURNSecret = ""
+		if servers, _, err := h.ICEServers(m.Peer.Token, "nebulink.example"); err != nil || len(servers) != 2 {
+			t.Errorf("without a secret: %+v, %v", servers, err)
+		}
+		if _, _, err := h.ICEServers("nope", "nebulink.example"); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("bad token: %v", err)
+		}
+	})
+}
@@ -0,0 +1,28 @@
+package signaling
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// roomShards is how many locks rooms are striped across
+const roomShards = 256
+
+// roomLocks serializes the load-modify-save of each room. Rooms hash onto a
+// fixed set of mutexes, so unrelated rooms rarely share one and memory stays
+// bounded however many rooms come and go.
+type roomLocks [roomShards]sync.Mutex
+
+// lock takes the lock for room code and returns its release
+func (l *roomLocks) lock(code string) func() {
+	m := &l[shardOf(code, roomShards)]
+	m.Lock()
+	return m.Unlock
+}
+
+// shardOf maps key onto one of n shards
+func shardOf(key string, n int) int {
+	f := fnv.New32a()
+	f.Write([]byte(key))
+	return int(f.Sum32() % uint32(n))
+}
@@ -0,0 +1,198 @@
+package signaling
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"galacticApps/middleware"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// pairingAlphabet leaves out 0/O, 1/I/L and U so codes survive being read
+// aloud or typed from a small screen
+const pairingAlphabet = "23456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// pairingCodeLen keeps codes short while 30^6 still makes guessing a live one
+// within its TTL impractical
+const pairingCodeLen = 6
+
+// normalizeCode lets a code typed by hand find its room: letters are
+// upper-cased and the spaces and dashes people add for readability dropped.
+// The codes of paired-device rooms are left alone.
+func normalizeCode(code string) string {
+	if strings.HasPrefix(code, deviceRoomPrefix) {
+		return code
+	}
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, code)
+}
+
+// Pair opens a room under a freshly minted pairing code with the peer called
+// name as its host. The code accepts new members until it expires; the
+// members already in the room are unaffected by expiry.
+func (h *Hub) Pair(name, ip string) (*Peer, time.Time, error) {
+	token, err := genToken()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	defer h.flush()
+	expires := time.Now().Add(h.cfg.PairingTTL)
+	m, err := h.mint(name, token, JoinOptions{IP: ip}, expires)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return m.Peer, expires, nil
+}
+
+// pairable reports whether code is a pairing code that still accepts members
+func (h *Hub) pairable(code string) (bool, error) {
+	code = normalizeCode(code)
+	defer h.rooms.lock(code)()
+	room, err := h.store.LoadRoom(code)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !room.Expires.IsZero() && time.Now().Before(room.Expires), nil
+}
+
+// genPairingCode returns a random code drawn from pairingAlphabet
+func genPairingCode() (string, error) {
+	b := make([]byte, pairingCodeLen)
+	max := big.NewInt(int64(len(pairingAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = pairingAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// pairingURL is the link a second device opens (or scans) to join code: the
+// configured base URL, or the NebuLink page on the host the request came in on
+func (h *Hub) pairingURL(r *http.Request, code string) string {
+	base := h.cfg.PairingBaseURL
+	if base == "" {
+		scheme := "https"
+		if r.TLS == nil && r.Header.Get("X-Forwarded-Proto") != "https" {
+			scheme = "http"
+		}
+		base = scheme + "://" + r.Host + "/"
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	q := u.Query()
+	q.Set("pair", code)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (h *Hub) handlePair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+
+	p, expires, err := h.Pair(req.Name, middleware.GetClientIP(r))
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"status":  "ok",
+		"code":    p.Code,
+		"token":   p.Token,
+		"expires": expires,
+		"url":     h.pairingURL(r, p.Code),
+	})
+}
+
+// handlePairQR renders the pairing URL for a live code as a QR code, as PNG
+// by default or SVG with ?format=svg
+func (h *Hub) handlePairQR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code := r.URL.Query().Get("code")
+	ok, err := h.pairable(code)
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "unknown or expired pairing code", http.StatusNotFound)
+		return
+	}
+
+	qr, err := qrcode.New(h.pairingURL(r, code), qrcode.Medium)
+	if err != nil {
+		h.httpError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.URL.Query().Get("format") {
+	case "", "png":
+		png, err := qr.PNG(256)
+		if err != nil {
+			h.httpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(png)
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, _ = w.Write(qrSVG(qr.Bitmap()))
+	default:
+		http.Error(w, "invalid format", http.StatusBadRequest)
+	}
+}
+
+// qrSVG draws a QR bitmap (quiet zone included) as one path of unit squares
+func qrSVG(bitmap [][]bool) []byte {
+	var buf bytes.Buffer
+	size := len(bitmap)
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
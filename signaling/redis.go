@@ -0,0 +1,273 @@
+package signaling
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisChannel is the pub/sub channel every Hub publishes to and listens on
+const redisChannel = "nebulink:signaling"
+
+// redisTimeout bounds dialling and each command. Publish runs while the Hub
+// flushes, which every room waits on, so a stalled server must fail fast.
+const redisTimeout = 2 * time.Second
+
+// RedisBroker fans envelopes out through Redis PUBLISH/SUBSCRIBE, speaking
+// RESP directly so any server implementing those two commands will do.
+type RedisBroker struct {
+	addr     string
+	username string
+	password string
+	logger   *log.Logger
+
+	pubMu sync.Mutex
+	pub   *respConn // lazily (re)dialled connection for PUBLISH
+
+	mu     sync.Mutex
+	subs   []func(Envelope)
+	sub    *respConn // connection currently in subscribe mode
+	closed bool
+	start  sync.Once
+}
+
+// NewRedisBroker prepares a broker for a URL like redis://:password@host:6379.
+// Connections are made on first use and re-established after failures.
+func NewRedisBroker(rawURL string, logger *log.Logger) (*RedisBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	b := &RedisBroker{addr: addr, logger: logger}
+	if u.User != nil {
+		b.username = u.User.Username()
+		b.password, _ = u.User.Password()
+	}
+	return b, nil
+}
+
+func (b *RedisBroker) Publish(env Envelope) error {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+
+	// one retry on a fresh connection covers a server restart or idle timeout
+	for attempt := 0; ; attempt++ {
+		if b.pub == nil {
+			if b.pub, err = b.dial(); err != nil {
+				return err
+			}
+		}
+		_, err = b.pub.do("PUBLISH", redisChannel, string(payload))
+		if err == nil {
+			return nil
+		}
+		b.pub.Close()
+		b.pub = nil
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+func (b *RedisBroker) Subscribe(fn func(Envelope)) {
+	b.mu.Lock()
+	b.subs = append(b.subs, fn)
+	b.mu.Unlock()
+	b.start.Do(func() { go b.listen() })
+}
+
+func (b *RedisBroker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	if b.sub != nil {
+		b.sub.Close()
+	}
+	b.mu.Unlock()
+
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+	if b.pub != nil {
+		b.pub.Close()
+		b.pub = nil
+	}
+	return nil
+}
+
+// listen keeps a subscription open, reconnecting with backoff until Close.
+// The backoff starts over once a subscription has been established.
+func (b *RedisBroker) listen() {
+	backoff := time.Second
+	for {
+		subscribed, err := b.subscribeOnce()
+		if subscribed {
+			backoff = time.Second
+		}
+		b.mu.Lock()
+		closed := b.closed
+		b.mu.Unlock()
+		if closed {
+			return
+		}
+		b.logger.Println("webrtc: redis subscription lost, retrying in", backoff, ":", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// subscribeOnce subscribes and delivers messages until the connection
+// fails, reporting whether the subscription was established at all
+func (b *RedisBroker) subscribeOnce() (bool, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return false, nil
+	}
+	b.sub = conn
+	b.mu.Unlock()
+
+	if _, err := conn.do("SUBSCRIBE", redisChannel); err != nil {
+		return false, err
+	}
+	// pushed messages arrive whenever someone publishes, however long that takes
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return true, err
+	}
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return true, err
+		}
+		// pushed messages look like ["message", channel, payload]
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		payload, _ := parts[2].(string)
+		var env Envelope
+		if err := json.Unmarshal([]byte(payload), &env); err != nil {
+			b.logger.Println("webrtc: dropping malformed broker message:", err)
+			continue
+		}
+		b.mu.Lock()
+		subs := b.subs
+		b.mu.Unlock()
+		for _, fn := range subs {
+			fn(env)
+		}
+	}
+}
+
+// dial connects and authenticates
+func (b *RedisBroker) dial() (*respConn, error) {
+	nc, err := net.DialTimeout("tcp", b.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &respConn{Conn: nc, r: bufio.NewReader(nc)}
+	if b.password != "" {
+		args := []string{"AUTH", b.password}
+		if b.username != "" {
+			args = []string{"AUTH", b.username, b.password}
+		}
+		if _, err := conn.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// respConn is a minimal RESP2 client connection
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and reads its reply, failing if that takes longer
+// than redisTimeout
+func (c *respConn) do(args ...string) (any, error) {
+	if err := c.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, a...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read parses one reply: simple strings and bulk strings become string,
+// integers int64, arrays []any, nil bulk/array nil, and errors an error
+func (c *respConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, errors.New("redis: " + body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+}
@@ -0,0 +1,249 @@
+package signaling
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a stand-in Redis server that understands just enough RESP
+// for the broker: AUTH, PUBLISH and SUBSCRIBE
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	subs  map[net.Conn]bool
+	// mute makes the server swallow commands without answering
+	mute bool
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, conns: make(map[net.Conn]bool), subs: make(map[net.Conn]bool)}
+	t.Cleanup(func() {
+		ln.Close()
+		f.dropAll()
+	})
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns[nc] = true
+			f.mu.Unlock()
+			go f.serve(nc)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) url(password string) string {
+	if password == "" {
+		return "redis://" + f.ln.Addr().String()
+	}
+	return "redis://:" + password + "@" + f.ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(nc net.Conn) {
+	defer f.forget(nc)
+	conn := &respConn{Conn: nc, r: bufio.NewReader(nc)}
+	authed := f.password == ""
+	for {
+		req, err := conn.read()
+		if err != nil {
+			return
+		}
+		args, _ := req.([]any)
+		if len(args) == 0 {
+			return
+		}
+		f.mu.Lock()
+		mute := f.mute
+		f.mu.Unlock()
+		if mute {
+			continue
+		}
+		cmd, _ := args[0].(string)
+		switch {
+		case cmd == "AUTH":
+			if args[len(args)-1] != f.password {
+				io.WriteString(nc, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			io.WriteString(nc, "+OK\r\n")
+		case !authed:
+			io.WriteString(nc, "-NOAUTH Authentication required.\r\n")
+		case cmd == "SUBSCRIBE":
+			f.mu.Lock()
+			f.subs[nc] = true
+			f.mu.Unlock()
+			io.WriteString(nc, "*3\r\n"+bulk("subscribe")+bulk(args[1].(string))+":1\r\n")
+		case cmd == "PUBLISH":
+			f.mu.Lock()
+			n := 0
+			for sub := range f.subs {
+				io.WriteString(sub, "*3\r\n"+bulk("message")+bulk(args[1].(string))+bulk(args[2].(string)))
+				n++
+			}
+			f.mu.Unlock()
+			io.WriteString(nc, ":"+strconv.Itoa(n)+"\r\n")
+		default:
+			io.WriteString(nc, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+// bulk encodes s as a RESP bulk string
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func (f *fakeRedis) forget(nc net.Conn) {
+	nc.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, nc)
+	delete(f.subs, nc)
+}
+
+// dropAll hangs up on every client, as a restarting server would
+func (f *fakeRedis) dropAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for nc := range f.conns {
+		nc.Close()
+	}
+}
+
+func (f *fakeRedis) subscribers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subs)
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// subscribedBroker connects a broker to f and waits for its subscription
+func subscribedBroker(t *testing.T, f *fakeRedis, url string) (*RedisBroker, <-chan Envelope) {
+	t.Helper()
+	b, err := NewRedisBroker(url, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	got := make(chan Envelope, 16)
+	b.Subscribe(func(env Envelope) { got <- env })
+	waitFor(t, "subscription", func() bool { return f.subscribers() == 1 })
+	return b, got
+}
+
+// expect waits for the next envelope and checks it is want
+func expect(t *testing.T, got <-chan Envelope, want Envelope) {
+	t.Helper()
+	select {
+	case env := <-got:
+		if env.Origin != want.Origin || env.Kind != want.Kind || env.Code != want.Code || env.Msg.Type != want.Msg.Type {
+			t.Fatalf("got %+v, want %+v", env, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message delivered")
+	}
+}
+
+func TestRedisBrokerPublishSubscribe(t *testing.T) {
+	f := newFakeRedis(t, "")
+	b, got := subscribedBroker(t, f, f.url(""))
+	env := Envelope{Origin: "a", Kind: KindSignal, Code: "ROOM", Msg: SignalMessage{Type: "offer"}}
+	if err := b.Publish(env); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, got, env)
+}
+
+func TestRedisBrokerAuth(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	b, got := subscribedBroker(t, f, f.url("secret"))
+	env := Envelope{Origin: "a", Kind: KindPresence, Code: "ROOM", Msg: SignalMessage{Type: EventPeerJoined}}
+	if err := b.Publish(env); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, got, env)
+
+	for _, password := range []string{"", "wrong"} {
+		bad, err := NewRedisBroker(f.url(password), log.New(io.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bad.Publish(env); err == nil {
+			t.Fatalf("publish with password %q succeeded", password)
+		}
+		bad.Close()
+	}
+}
+
+func TestRedisBrokerReconnect(t *testing.T) {
+	f := newFakeRedis(t, "")
+	b, got := subscribedBroker(t, f, f.url(""))
+	first := Envelope{Origin: "a", Kind: KindSignal, Code: "ROOM", Msg: SignalMessage{Type: "before"}}
+	if err := b.Publish(first); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, got, first)
+
+	f.dropAll()
+	waitFor(t, "the old subscription to go", func() bool { return f.subscribers() == 0 })
+	waitFor(t, "resubscription", func() bool { return f.subscribers() == 1 })
+
+	// the publishing connection was dropped too and is redialled
+	second := Envelope{Origin: "a", Kind: KindSignal, Code: "ROOM", Msg: SignalMessage{Type: "after"}}
+	if err := b.Publish(second); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, got, second)
+}
+
+func TestRedisBrokerPublishTimesOut(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out the command timeout")
+	}
+	f := newFakeRedis(t, "")
+	f.mute = true
+	b, err := NewRedisBroker(f.url(""), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	start := time.Now()
+	if err := b.Publish(Envelope{Kind: KindSignal}); err == nil {
+		t.Fatal("publish to a silent server succeeded")
+	}
+	// one attempt plus one retry on a fresh connection
+	if elapsed := time.Since(start); elapsed > 3*redisTimeout {
+		t.Fatalf("publish took %v", elapsed)
+	}
+}
@@ -0,0 +1,49 @@
+package signaling
+
+import "time"
+
+// TypeRelay marks an opaque application frame the server forwards between
+// two members whose peer connection could not be established. Relay frames
+// must name their recipient, are never held for members yet to join, and
+// count against the room's relay bandwidth.
+const TypeRelay = "relay"
+
+// relayBucket is a token bucket of relay bytes for one room
+type relayBucket struct {
+	bytes float64
+	last  time.Time
+}
+
+// relayAllow spends n bytes of room code's relay bandwidth, reporting false
+// (and spending nothing) if the room has used up its burst
+func (h *Hub) relayAllow(code string, n int, now time.Time) bool {
+	l := h.cfg.Limits
+	h.relayMu.Lock()
+	defer h.relayMu.Unlock()
+	b := h.relay[code]
+	if b == nil {
+		b = &relayBucket{bytes: float64(l.RelayBurstBytes), last: now}
+		h.relay[code] = b
+	}
+	b.bytes = min(float64(l.RelayBurstBytes), b.bytes+now.Sub(b.last).Seconds()*float64(l.RelayBytesPerSec))
+	b.last = now
+	if b.bytes < float64(n) {
+		return false
+	}
+	b.bytes -= float64(n)
+	return true
+}
+
+// expireRelay forgets the buckets that have refilled completely; a room
+// starting afresh gets a full one anyway
+func (h *Hub) expireRelay(now time.Time) {
+	l := h.cfg.Limits
+	refill := time.Duration(float64(l.RelayBurstBytes) / float64(l.RelayBytesPerSec) * float64(time.Second))
+	h.relayMu.Lock()
+	defer h.relayMu.Unlock()
+	for code, b := range h.relay {
+		if now.Sub(b.last) > refill {
+			delete(h.relay, code)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package signaling
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// remotePeer is a room member connected to another instance, as learned
+// from the Broker
+type remotePeer struct {
+	origin string
+	joined time.Time
+	seen   time.Time
+}
+
+// publish queues env for the Broker; it goes out on the next flush
+func (h *Hub) publish(env Envelope) {
+	env.Origin = h.id
+	h.outMu.Lock()
+	defer h.outMu.Unlock()
+	h.outbox = append(h.outbox, env)
+}
+
+// flush hands queued envelopes to the publisher without waiting for them to
+// go out, so a slow Broker never holds up the rooms
+func (h *Hub) flush() {
+	h.outMu.Lock()
+	pending := len(h.outbox) > 0
+	h.outMu.Unlock()
+	if !pending {
+		return
+	}
+	select {
+	case h.outWake <- struct{}{}:
+	default:
+	}
+}
+
+// settle flushes and waits until the publisher has handed everything queued
+// to the Broker
+func (h *Hub) settle() {
+	h.flush()
+	h.outMu.Lock()
+	defer h.outMu.Unlock()
+	for len(h.outbox) > 0 || h.sending {
+		h.outIdle.Wait()
+	}
+}
+
+// publisher hands queued envelopes to the Broker in the order they were
+// queued, one at a time, for as long as the Hub lives
+func (h *Hub) publisher() {
+	for range h.outWake {
+		for {
+			h.outMu.Lock()
+			out := h.outbox
+			h.outbox = nil
+			h.sending = len(out) > 0
+			if !h.sending {
+				h.outIdle.Broadcast()
+			}
+			h.outMu.Unlock()
+			if len(out) == 0 {
+				break
+			}
+			for _, env := range out {
+				if err := h.broker.Publish(env); err != nil {
+					h.logger.Println("webrtc: broker publish failed:", err)
+				}
+			}
+		}
+	}
+}
+
+// receive applies an envelope published by another instance
+func (h *Hub) receive(env Envelope) {
+	if env.Origin == h.id {
+		return
+	}
+	unlock := h.rooms.lock(env.Code)
+	defer unlock()
+
+	var err error
+	switch env.Kind {
+	case KindSignal:
+		err = h.deliverRemote(env.Msg)
+	case KindPresence:
+		name := subject(env.Msg)
+		switch env.Msg.Type {
+		case EventPeerJoined:
+			h.addRemote(env.Code, name, env.Origin, env.Joined[name])
+			// tell the newcomer's instance who is already here and what
+			// the room's state is
+			if announce, ok := h.announcement(env.Code, true); ok {
+				h.publish(announce)
+			}
+			err = h.mergeState(env.Code, env.State)
+			if err == nil {
+				err = h.notifyLocal(env.Code, env.Msg)
+			}
+			if err == nil {
+				err = h.forwardHeld(env.Code, name)
+			}
+			if err == nil {
+				err = h.reelect(env.Code)
+			}
+		case EventPeerLeft, EventPeerTimedOut, EventPeerKicked:
+			if h.dropRemote(env.Code, name, env.Origin) {
+				err = h.notifyLocal(env.Code, env.Msg)
+				if err == nil {
+					err = h.reelect(env.Code)
+				}
+			}
+		case EventRoomClosed:
+			h.forgetRemote(env.Code)
+			err = h.closeLocal(env.Code)
+		}
+	case KindKick:
+		err = h.kickLocal(env.Code, subject(env.Msg))
+	case KindState:
+		err = h.applyRemoteState(env.Msg)
+	case KindAnnounce:
+		err = h.mergeState(env.Code, env.State)
+		for _, name := range env.Names {
+			if h.addRemote(env.Code, name, env.Origin, env.Joined[name]) && err == nil {
+				err = h.notifyLocal(env.Code, presence(env.Code, EventPeerJoined, name))
+			}
+		}
+		if err == nil {
+			err = h.reelect(env.Code)
+		}
+	}
+	if err != nil {
+		h.logger.Println("webrtc: applying", env.Kind, "from", env.Origin, "failed:", err)
+	}
+
+	h.flush()
+}
+
+// deliverRemote queues a SignalMessage sent from another instance for the
+// local members it is addressed to. Callers must hold the room's lock.
+func (h *Hub) deliverRemote(msg SignalMessage) error {
+	room, err := h.store.LoadRoom(msg.Code)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	if msg.To != "" && room.Peers[msg.To] == nil {
+		return nil
+	}
+	targets, err := room.route(msg, h.cfg.Limits)
+	if err != nil {
+		return err
+	}
+	if err := h.store.SaveRoom(room); err != nil {
+		return err
+	}
+	for _, t := range targets {
+		h.wake(t.Token)
+	}
+	return nil
+}
+
+// notifyLocal queues a server-originated event for every local member of
+// room code. Callers must hold the room's lock.
+func (h *Hub) notifyLocal(code string, msg SignalMessage) error {
+	room, err := h.store.LoadRoom(code)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	h.notifyRoom(room, "", msg)
+	return h.store.SaveRoom(room)
+}
+
+// forwardHeld sends whatever this instance held for name in room code on to
+// the instance name just joined. Callers must hold the room's lock.
+func (h *Hub) forwardHeld(code, name string) error {
+	room, err := h.store.LoadRoom(code)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	msgs := room.takeHeld(name, time.Now())
+	if len(msgs) == 0 {
+		return nil
+	}
+	for _, msg := range msgs {
+		h.publish(Envelope{Kind: KindSignal, Code: code, Msg: msg})
+	}
+	return h.commit(room)
+}
+
+// closeLocal drops the local side of room code after its host closed it on
+// another instance. Callers must hold the room's lock.
+func (h *Hub) closeLocal(code string) error {
+	room, err := h.store.LoadRoom(code)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	return h.dropRoom(room)
+}
+
+// kickLocal removes the local member name of room code for a host on
+// another instance. Callers must hold the room's lock.
+func (h *Hub) kickLocal(code, name string) error {
+	room, err := h.store.LoadRoom(code)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	target := room.Peers[name]
+	if target == nil {
+		return nil
+	}
+	h.kick(room, target)
+	return h.commit(room)
+}
+
+// addRemote records name as present in room code on instance origin since
+// joined (now if unknown) and reports whether it was not known before
+func (h *Hub) addRemote(code, name, origin string, joined time.Time) bool {
+	h.remoteMu.Lock()
+	defer h.remoteMu.Unlock()
+	members := h.remote[code]
+	if members == nil {
+		members = make(map[string]*remotePeer)
+		h.remote[code] = members
+	}
+	old, known := members[name]
+	now := time.Now()
+	if joined.IsZero() {
+		joined = now
+		if known {
+			joined = old.joined
+		}
+	}
+	members[name] = &remotePeer{origin: origin, joined: joined, seen: now}
+	return !known
+}
+
+// dropRemote forgets name in room code if origin still owns it
+func (h *Hub) dropRemote(code, name, origin string) bool {
+	h.remoteMu.Lock()
+	defer h.remoteMu.Unlock()
+	rp := h.remote[code][name]
+	if rp == nil || rp.origin != origin {
+		return false
+	}
+	delete(h.remote[code], name)
+	if len(h.remote[code]) == 0 {
+		delete(h.remote, code)
+	}
+	return true
+}
+
+// remoteNames lists members of room code held by other instances, except self
+func (h *Hub) remoteNames(code, self string) []string {
+	h.remoteMu.Lock()
+	defer h.remoteMu.Unlock()
+	var names []string
+	for name := range h.remote[code] {
+		if name != self {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isRemote reports whether name is a member of room code on another instance
+func (h *Hub) isRemote(code, name string) bool {
+	h.remoteMu.Lock()
+	defer h.remoteMu.Unlock()
+	return h.remote[code][name] != nil
+}
+
+// remoteCount is how many members of room code are on other instances
+func (h *Hub) remoteCount(code string) int {
+	h.remoteMu.Lock()
+	defer h.remoteMu.Unlock()
+	return len(h.remote[code])
+}
+
+// forgetRemote drops every remote member of room code
+func (h *Hub) forgetRemote(code string) {
+	h.remoteMu.Lock()
+	defer h.remoteMu.Unlock()
+	delete(h.remote, code)
+}
+
+// announcement is the KindAnnounce listing the members of room code
+// connected to this instance, and its state document if withState is set,
+// unless there is nothing to say. Callers must hold the room's lock.
+func (h *Hub) announcement(code string, withState bool) (Envelope, bool) {
+	room, err := h.store.LoadRoom(code)
+	if err != nil {
+		return Envelope{}, false
+	}
+	env := Envelope{Kind: KindAnnounce, Code: code, Joined: make(map[string]time.Time)}
+	for name, p := range room.Peers {
+		env.Names = append(env.Names, name)
+		env.Joined[name] = p.Joined
+	}
+	if withState && !room.State.empty() {
+		env.State = room.State
+	}
+	return env, len(env.Names) > 0 || env.State != nil
+}
+
+// reelect runs electHost for the local side of room code after its remote
+// membership changed, telling the local members if the host moved. Callers
+// must hold the room's lock.
+func (h *Hub) reelect(code string) error {
+	room, err := h.store.LoadRoom(code)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	if !h.electHost(room) {
+		return nil
+	}
+	if room.Host != "" {
+		h.notifyRoom(room, "", presence(code, EventHostChanged, room.Host))
+	}
+	return h.store.SaveRoom(room)
+}
+
+// announceAll republishes every local room's membership so other instances
+// keep their remote entries fresh
+func (h *Hub) announceAll() error {
+	codes, err := h.store.Rooms()
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		unlock := h.rooms.lock(code)
+		announce, ok := h.announcement(code, false)
+		unlock()
+		if ok {
+			h.publish(announce)
+		}
+	}
+	return nil
+}
+
+// expireRemote forgets remote members whose instance has gone quiet and
+// tells local members they timed out
+func (h *Hub) expireRemote(cutoff time.Time) error {
+	type member struct{ code, name string }
+	var expired []member
+	h.remoteMu.Lock()
+	for code, members := range h.remote {
+		for name, rp := range members {
+			if rp.seen.Before(cutoff) {
+				delete(members, name)
+				expired = append(expired, member{code, name})
+			}
+		}
+		if len(members) == 0 {
+			delete(h.remote, code)
+		}
+	}
+	h.remoteMu.Unlock()
+
+	for _, m := range expired {
+		unlock := h.rooms.lock(m.code)
+		err := h.notifyLocal(m.code, presence(m.code, EventPeerTimedOut, m.name))
+		if err == nil {
+			err = h.reelect(m.code)
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subject extracts the peer name a presence event is about
+func subject(msg SignalMessage) string {
+	var data struct {
+		Name string `json:"name"`
+	}
+	_ = json.Unmarshal(msg.Data, &data)
+	return data.Name
+}
+
+func ignoreNotFound(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,421 @@
+// Package signaling implements the WebRTC signaling rooms used to pair
+// NebuLink devices: peers join a room by code, exchange SignalMessages over
+// HTTP polling or WebSocket, and are told by the server when others come
+// and go.
+package signaling
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"galacticApps/middleware"
+	"net"
+	"time"
+)
+
+// SignalMessage is the JSON shape used to exchange signaling payloads between peers
+type SignalMessage struct {
+	Code string          `json:"code"`
+	From string          `json:"from"`
+	To   string          `json:"to,omitempty"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// Seq is assigned by the server per recipient and only ever increases;
+	// clients acknowledge what they have processed by echoing it back
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// Presence events are SignalMessages generated by the server itself rather
+// than relayed from a peer; they carry an empty From and {"name": ...} data.
+const (
+	EventPeerJoined   = "peer-joined"
+	EventPeerLeft     = "peer-left"
+	EventPeerTimedOut = "peer-timed-out"
+	EventRoomClosed   = "room-closed"
+	EventPeerKicked   = "peer-kicked"  // also sent to the kicked peer itself
+	EventHostChanged  = "host-changed" // names the new host
+	// EventStateChanged carries {"key", "value", "version", "by", "updated"}
+	// rather than a name
+	EventStateChanged = "state-changed"
+	// EventDevicePaired carries {"name", "device"}: the member called name
+	// registered device, which is now paired with the recipient's
+	EventDevicePaired = "device-paired"
+)
+
+// NameConflict is what Join does when the requested name is already in use
+type NameConflict string
+
+const (
+	// ConflictReject fails the join with ErrNameTaken
+	ConflictReject NameConflict = "reject"
+	// ConflictSuffix joins under the first free name-2, name-3, ...
+	ConflictSuffix NameConflict = "suffix"
+	// conflictReplace removes the member holding the name first; devices
+	// reconnecting to their own room use it to take over a stale session
+	conflictReplace NameConflict = "replace"
+)
+
+var (
+	ErrUnauthorized    = errors.New("invalid or missing peer token")
+	ErrTargetNotFound  = errors.New("target not found")
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrQueueFull       = errors.New("recipient queue full")
+	ErrCodeExpired     = errors.New("pairing code expired")
+	ErrNameTaken       = errors.New("name taken")
+	ErrRoomFull        = errors.New("room full")
+	ErrRoomExists      = errors.New("room already exists")
+	ErrNotHost         = errors.New("only the host can do that")
+	ErrVersionConflict = errors.New("version conflict")
+	ErrStateFull       = errors.New("room state full")
+	ErrInvalidKey      = errors.New("invalid state key")
+	ErrBadChallenge    = errors.New("invalid or expired challenge")
+	ErrBadSignature    = errors.New("invalid device signature")
+	ErrUnknownDevice   = errors.New("unknown device")
+	ErrNotPaired       = errors.New("devices not paired")
+	ErrNotPairingRoom  = errors.New("devices can only register in a room opened with a pairing code")
+	ErrRelayLimit      = errors.New("relay bandwidth exceeded")
+	ErrDropTooLarge    = errors.New("file too large")
+	ErrDropFull        = errors.New("room drop space full")
+	ErrDropNotFound    = errors.New("unknown or expired drop")
+	ErrDropOffset      = errors.New("upload offset mismatch")
+	ErrDropIncomplete  = errors.New("drop not complete")
+	ErrNotRecipient    = errors.New("not a recipient of this drop")
+)
+
+// Peer represents a participant waiting in a room
+type Peer struct {
+	Name     string    `json:"name"`
+	Code     string    `json:"code"`
+	IP       string    `json:"ip,omitempty"`     // as observed by the server
+	Device   string    `json:"device,omitempty"` // registered Device ID, if any
+	Queue    []queued  `json:"queue"`
+	Seq      uint64    `json:"seq"` // last sequence number assigned
+	Joined   time.Time `json:"joined"`
+	LastSeen time.Time `json:"last_seen"`
+
+	// Token authenticates signal, poll and leave calls made on behalf of this
+	// peer; it is only ever returned to the client that joined
+	Token string `json:"token"`
+}
+
+// queued is a message waiting for its recipient to acknowledge it
+type queued struct {
+	Msg SignalMessage `json:"msg"`
+	// Delivered is when the message was first handed to the client; it is
+	// kept for replay until acknowledged or the replay window runs out
+	Delivered time.Time `json:"delivered,omitzero"`
+}
+
+// delivery selects what take hands over
+type delivery int
+
+const (
+	// deliverOnce hands over everything and forgets it, for clients that never ack
+	deliverOnce delivery = iota
+	// deliverUnacked hands over everything not yet acknowledged, replaying
+	// what an earlier response may have lost
+	deliverUnacked
+	// deliverNew hands over only what has never been handed over, for a live
+	// WebSocket where earlier frames are known to have been written
+	deliverNew
+)
+
+// push numbers msg for this peer and queues it
+func (p *Peer) push(msg SignalMessage) {
+	p.Seq++
+	msg.Seq = p.Seq
+	p.Queue = append(p.Queue, queued{Msg: msg})
+}
+
+// ack drops every message up to and including seq
+func (p *Peer) ack(seq uint64) {
+	i := 0
+	for i < len(p.Queue) && p.Queue[i].Msg.Seq <= seq {
+		i++
+	}
+	p.Queue = p.Queue[i:]
+}
+
+// take returns the messages selected by mode and records their delivery.
+// Delivered messages older than window are dropped unacknowledged first.
+func (p *Peer) take(mode delivery, window time.Duration, now time.Time) []SignalMessage {
+	msgs := []SignalMessage{}
+	if mode == deliverOnce {
+		for _, q := range p.Queue {
+			msgs = append(msgs, q.Msg)
+		}
+		p.Queue = []queued{}
+		return msgs
+	}
+
+	kept := p.Queue[:0]
+	for _, q := range p.Queue {
+		if !q.Delivered.IsZero() && now.Sub(q.Delivered) > window {
+			continue
+		}
+		if q.Delivered.IsZero() || mode == deliverUnacked {
+			msgs = append(msgs, q.Msg)
+		}
+		if q.Delivered.IsZero() {
+			q.Delivered = now
+		}
+		kept = append(kept, q)
+	}
+	p.Queue = kept
+	return msgs
+}
+
+// messages returns whatever is still queued, without touching it
+func (p *Peer) messages() []SignalMessage {
+	msgs := make([]SignalMessage, len(p.Queue))
+	for i, q := range p.Queue {
+		msgs[i] = q.Msg
+	}
+	return msgs
+}
+
+// queuedBytes is the buffered footprint of everything in the peer's queue
+func (p *Peer) queuedBytes() int {
+	n := 0
+	for _, q := range p.Queue {
+		n += msgSize(q.Msg)
+	}
+	return n
+}
+
+// notify queues a server-generated event for p. Events cannot be refused,
+// so when p's queue is at its limits the oldest messages make way for it
+// whatever the policy.
+func (p *Peer) notify(msg SignalMessage, l Limits) {
+	size := msgSize(msg)
+	queued := p.queuedBytes()
+	for len(p.Queue) > 0 && (len(p.Queue) >= l.MaxQueueLen || queued+size > l.MaxPeerBytes) {
+		queued -= msgSize(p.Queue[0].Msg)
+		p.Queue = p.Queue[1:]
+	}
+	p.push(msg)
+}
+
+// evictions reports how many of p's oldest messages have to be discarded
+// before it can take one more of size bytes while the room as a whole holds
+// roomBytes, and how many bytes that frees. It fails with ErrQueueFull when
+// the policy does not allow discarding. p is left untouched.
+func (p *Peer) evictions(size, roomBytes int, l Limits) (n, freed int, err error) {
+	queued := p.queuedBytes()
+	for len(p.Queue)-n >= l.MaxQueueLen || queued-freed+size > l.MaxPeerBytes || roomBytes-freed+size > l.MaxRoomBytes {
+		if !l.DropOldest || n == len(p.Queue) {
+			return 0, 0, ErrQueueFull
+		}
+		freed += msgSize(p.Queue[n].Msg)
+		n++
+	}
+	return n, freed, nil
+}
+
+// Room is a signaling room and everyone currently in it
+type Room struct {
+	Code  string           `json:"code"`
+	Peers map[string]*Peer `json:"peers"`
+
+	// Host is the member allowed to kick others and close the room: whoever
+	// has been there longest, on whichever instance they joined
+	Host string `json:"host,omitempty"`
+	// Expires is set for rooms opened with a server-issued pairing code;
+	// nobody new may join once it has passed
+	Expires time.Time `json:"expires,omitzero"`
+	// Held keeps messages addressed to names that have not joined yet,
+	// delivered when they do or dropped once their TTL runs out
+	Held map[string][]held `json:"held,omitempty"`
+	// State is the document the members share, if any has been written
+	State *Document `json:"state,omitempty"`
+	// Idle is when the last member left a room kept for its State or Held
+	// messages; the State goes StateTTL later
+	Idle time.Time `json:"idle,omitzero"`
+}
+
+// held is a message waiting for its recipient to join
+type held struct {
+	Msg     SignalMessage `json:"msg"`
+	Expires time.Time     `json:"expires"`
+}
+
+func newRoom(code string) *Room {
+	return &Room{Code: code, Peers: make(map[string]*Peer)}
+}
+
+// others returns the names of everyone in the room except self
+func (r *Room) others(self string) []string {
+	others := []string{}
+	for n := range r.Peers {
+		if n != self {
+			others = append(others, n)
+		}
+	}
+	return others
+}
+
+// peer returns the member owning token, if any
+func (r *Room) peer(token string) *Peer {
+	for _, p := range r.Peers {
+		if p.Token == token {
+			return p
+		}
+	}
+	return nil
+}
+
+// queuedBytes is the total waiting across every peer in the room, including
+// what is held for peers still to come
+func (r *Room) queuedBytes() int {
+	n := 0
+	for _, p := range r.Peers {
+		n += p.queuedBytes()
+	}
+	for _, msgs := range r.Held {
+		for _, m := range msgs {
+			n += msgSize(m.Msg)
+		}
+	}
+	return n
+}
+
+// hold keeps msg for msg.To, who has not joined yet, until expires. Held
+// messages count against the same limits as queued ones but are never
+// dropped to make space.
+func (r *Room) hold(msg SignalMessage, expires time.Time, l Limits) error {
+	size := msgSize(msg)
+	if size > l.MaxMessageBytes {
+		return ErrMessageTooLarge
+	}
+	if len(r.Held[msg.To]) >= l.MaxQueueLen || r.queuedBytes()+size > l.MaxRoomBytes {
+		return ErrQueueFull
+	}
+	if r.Held == nil {
+		r.Held = make(map[string][]held)
+	}
+	r.Held[msg.To] = append(r.Held[msg.To], held{Msg: msg, Expires: expires})
+	return nil
+}
+
+// takeHeld removes and returns the unexpired messages held for name
+func (r *Room) takeHeld(name string, now time.Time) []SignalMessage {
+	var msgs []SignalMessage
+	for _, m := range r.Held[name] {
+		if now.Before(m.Expires) {
+			msgs = append(msgs, m.Msg)
+		}
+	}
+	delete(r.Held, name)
+	return msgs
+}
+
+// expireHeld drops held messages past their TTL and reports whether any were
+func (r *Room) expireHeld(now time.Time) bool {
+	changed := false
+	for name, msgs := range r.Held {
+		kept := msgs[:0]
+		for _, m := range msgs {
+			if now.Before(m.Expires) {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) != len(msgs) {
+			changed = true
+		}
+		if len(kept) == 0 {
+			delete(r.Held, name)
+		} else {
+			r.Held[name] = kept
+		}
+	}
+	return changed
+}
+
+// route queues msg for its target, or for every other member when To is
+// empty, within the limits l, and returns the peers that received it.
+func (r *Room) route(msg SignalMessage, l Limits) ([]*Peer, error) {
+	size := msgSize(msg)
+	if size > l.MaxMessageBytes {
+		return nil, ErrMessageTooLarge
+	}
+	var targets []*Peer
+	if msg.To != "" {
+		target, ok := r.Peers[msg.To]
+		if !ok {
+			return nil, ErrTargetNotFound
+		}
+		targets = append(targets, target)
+	} else {
+		for name, peer := range r.Peers {
+			if name != msg.From {
+				targets = append(targets, peer)
+			}
+		}
+	}
+
+	// check every recipient has space before discarding or queueing
+	// anything, so a failed signal leaves the room as it was and a broadcast
+	// is never delivered to only part of it
+	evict := make([]int, len(targets))
+	roomBytes := r.queuedBytes()
+	for i, t := range targets {
+		n, freed, err := t.evictions(size, roomBytes, l)
+		if err != nil {
+			return nil, err
+		}
+		evict[i] = n
+		roomBytes += size - freed
+	}
+	for i, t := range targets {
+		t.Queue = t.Queue[evict[i]:]
+		t.push(msg)
+	}
+	return targets, nil
+}
+
+// msgSize approximates the buffered footprint of msg
+func msgSize(msg SignalMessage) int {
+	return len(msg.Code) + len(msg.From) + len(msg.To) + len(msg.Type) + len(msg.Data)
+}
+
+// presence builds a server-originated event about name in room code
+func presence(code, event, name string) SignalMessage {
+	msg := SignalMessage{Code: code, Type: event}
+	if name != "" {
+		msg.Data, _ = json.Marshal(map[string]string{"name": name})
+	}
+	return msg
+}
+
+// joinedEvent is the peer-joined event about name as sent to one member,
+// flagging whether the newcomer shares that member's public address
+func joinedEvent(code, name string, sameNetwork bool) SignalMessage {
+	msg := presence(code, EventPeerJoined, name)
+	if sameNetwork {
+		msg.Data, _ = json.Marshal(map[string]any{"name": name, "sameNetwork": true})
+	}
+	return msg
+}
+
+// sameNetwork reports whether a and b were seen coming from the same
+// public address. Loopback and private addresses, and those of trusted
+// proxies, say nothing about where a client is: behind a proxy nobody
+// trusts, every client looks like the proxy.
+func sameNetwork(a, b *Peer) bool {
+	if a.IP == "" || a.IP != b.IP {
+		return false
+	}
+	ip := net.ParseIP(a.IP)
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate() && !middleware.TrustedProxy(a.IP)
+}
+
+// genToken returns an unguessable bearer token for a signaling peer
+func genToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
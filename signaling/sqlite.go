@@ -0,0 +1,192 @@
+package signaling
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore keeps rooms and the device registry in a SQLite database so
+// they survive restarts. Each room is stored as one JSON document next to an
+// index of its tokens.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS signaling_rooms (
+	code TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS signaling_tokens (
+	token TEXT PRIMARY KEY,
+	code  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS signaling_tokens_code ON signaling_tokens (code);
+CREATE TABLE IF NOT EXISTS signaling_devices (
+	id         TEXT PRIMARY KEY,
+	public_key BLOB NOT NULL,
+	name       TEXT NOT NULL,
+	registered TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS signaling_pairings (
+	device TEXT NOT NULL,
+	peer   TEXT NOT NULL,
+	PRIMARY KEY (device, peer)
+);
+`
+
+// OpenSQLiteStore opens (creating if needed) the database at path
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes writers and avoids SQLITE_BUSY churn
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) LoadRoom(code string) (*Room, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM signaling_rooms WHERE code = ?`, code).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	room := newRoom(code)
+	if err := json.Unmarshal(data, room); err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+func (s *SQLiteStore) SaveRoom(room *Room) error {
+	data, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO signaling_rooms (code, data) VALUES (?, ?)
+		ON CONFLICT (code) DO UPDATE SET data = excluded.data`, room.Code, data); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM signaling_tokens WHERE code = ?`, room.Code); err != nil {
+		return err
+	}
+	for _, p := range room.Peers {
+		if _, err := tx.Exec(`INSERT INTO signaling_tokens (token, code) VALUES (?, ?)`, p.Token, room.Code); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteRoom(code string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM signaling_tokens WHERE code = ?`, code); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM signaling_rooms WHERE code = ?`, code); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) LookupToken(token string) (string, error) {
+	var code string
+	err := s.db.QueryRow(`SELECT code FROM signaling_tokens WHERE token = ?`, token).Scan(&code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return code, err
+}
+
+func (s *SQLiteStore) Rooms() ([]string, error) {
+	rows, err := s.db.Query(`SELECT code FROM signaling_rooms`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+func (s *SQLiteStore) SaveDevice(d *Device) error {
+	_, err := s.db.Exec(`INSERT INTO signaling_devices (id, public_key, name, registered) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name`, d.ID, []byte(d.PublicKey), d.Name, d.Registered)
+	return err
+}
+
+func (s *SQLiteStore) LoadDevice(id string) (*Device, error) {
+	d := &Device{ID: id}
+	var key []byte
+	err := s.db.QueryRow(`SELECT public_key, name, registered FROM signaling_devices WHERE id = ?`, id).
+		Scan(&key, &d.Name, &d.Registered)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.PublicKey = key
+	return d, nil
+}
+
+func (s *SQLiteStore) SavePairing(a, b string) error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO signaling_pairings (device, peer) VALUES (?, ?), (?, ?)`, a, b, b, a)
+	return err
+}
+
+func (s *SQLiteStore) DeletePairing(a, b string) error {
+	_, err := s.db.Exec(`DELETE FROM signaling_pairings WHERE (device = ? AND peer = ?) OR (device = ? AND peer = ?)`, a, b, b, a)
+	return err
+}
+
+func (s *SQLiteStore) Pairings(id string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT peer FROM signaling_pairings WHERE device = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var peer string
+		if err := rows.Scan(&peer); err != nil {
+			return nil, err
+		}
+		ids = append(ids, peer)
+	}
+	return ids, rows.Err()
+}
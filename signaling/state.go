@@ -0,0 +1,249 @@
+package signaling
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// maxStateKeyLen bounds the keys of a room's state document
+const maxStateKeyLen = 128
+
+// Document is a room's shared state: small JSON values such as the toot a
+// device has open or its scroll anchor, so another device can pick up
+// exactly where it left off. Every change bumps Version, and each entry
+// remembers the Version at which it last changed for compare-and-set. The
+// document outlives the room's last member by StateTTL, so someone joining
+// the same code later still finds it.
+type Document struct {
+	Version uint64           `json:"version"`
+	Entries map[string]Entry `json:"entries"`
+}
+
+// Entry is one key of a Document
+type Entry struct {
+	Value   json.RawMessage `json:"value"`
+	Version uint64          `json:"version"`
+	By      string          `json:"by"` // the member that wrote it
+	Updated time.Time       `json:"updated"`
+}
+
+// stateChange is the data of an EventStateChanged; a null Value means the
+// key was deleted
+type stateChange struct {
+	Key string `json:"key"`
+	Entry
+}
+
+// empty reports whether d holds no entries; d may be nil
+func (d *Document) empty() bool {
+	return d == nil || len(d.Entries) == 0
+}
+
+// size is the stored footprint of d
+func (d *Document) size() int {
+	n := 0
+	for k, e := range d.Entries {
+		n += len(k) + len(e.Value)
+	}
+	return n
+}
+
+// State returns a copy of the state document of the room the peer owning
+// token is in
+func (h *Hub) State(token string) (Document, error) {
+	room, _, unlock, err := h.authenticate(token)
+	if err != nil {
+		return Document{}, err
+	}
+	defer unlock()
+	doc := Document{Entries: map[string]Entry{}}
+	if room.State != nil {
+		doc.Version = room.State.Version
+		for k, e := range room.State.Entries {
+			doc.Entries[k] = e
+		}
+	}
+	return doc, nil
+}
+
+// SetState writes key in the room's state document on behalf of the peer
+// owning token; a nil or JSON null value deletes it. With ifVersion set the
+// write only happens if the key is still at that version (0: absent), and
+// ErrVersionConflict is returned otherwise. Every other member is sent an
+// EventStateChanged, and other instances apply the change to their copy.
+func (h *Hub) SetState(token, key string, value json.RawMessage, ifVersion *uint64) (uint64, error) {
+	if key == "" || len(key) > maxStateKeyLen {
+		return 0, ErrInvalidKey
+	}
+	if string(value) == "null" {
+		value = nil
+	}
+
+	defer h.flush()
+	room, p, unlock, err := h.authenticate(token)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	if room.State == nil {
+		room.State = &Document{Entries: map[string]Entry{}}
+	}
+	doc := room.State
+	current, exists := doc.Entries[key]
+	if ifVersion != nil && *ifVersion != current.Version {
+		return 0, ErrVersionConflict
+	}
+	if value == nil && !exists {
+		return doc.Version, nil
+	}
+	if value != nil {
+		after := doc.size() - len(current.Value) + len(value)
+		if !exists {
+			after += len(key)
+		}
+		// shrinking a value is always allowed, even over a lowered limit
+		if after > h.cfg.Limits.MaxStateBytes && len(value) > len(current.Value) {
+			return 0, ErrStateFull
+		}
+	}
+
+	doc.Version++
+	change := stateChange{Key: key, Entry: Entry{Value: value, Version: doc.Version, By: p.Name, Updated: time.Now()}}
+	h.applyState(room, change, p.Name)
+	if err := h.store.SaveRoom(room); err != nil {
+		return 0, err
+	}
+	h.publish(Envelope{Kind: KindState, Code: room.Code, Msg: change.event(room.Code)})
+	return doc.Version, nil
+}
+
+// applyState records change in room's document and tells every member but
+// skip, replacing any notification about the same key they have not been
+// handed yet. Callers must hold the room's lock.
+func (h *Hub) applyState(room *Room, change stateChange, skip string) {
+	if room.State == nil {
+		room.State = &Document{Entries: map[string]Entry{}}
+	}
+	if change.Value == nil {
+		delete(room.State.Entries, change.Key)
+	} else {
+		room.State.Entries[change.Key] = change.Entry
+	}
+	room.State.Version = max(room.State.Version, change.Version)
+
+	msg := change.event(room.Code)
+	for name, p := range room.Peers {
+		if name == skip {
+			continue
+		}
+		p.coalesceState(change.Key)
+		p.notify(msg, h.cfg.Limits)
+		h.wake(p.Token)
+	}
+}
+
+// applyRemoteState takes a change made on another instance, unless the local
+// copy already has something newer for that key. Callers must hold the
+// room's lock.
+func (h *Hub) applyRemoteState(msg SignalMessage) error {
+	room, err := h.store.LoadRoom(msg.Code)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	var change stateChange
+	if err := json.Unmarshal(msg.Data, &change); err != nil {
+		return err
+	}
+	if room.State != nil && room.State.Entries[change.Key].Version >= change.Version {
+		return nil
+	}
+	h.applyState(room, change, "")
+	return h.store.SaveRoom(room)
+}
+
+// mergeState takes the entries of doc, room code's document as another
+// instance has it, that are newer than the local copy; a member joining
+// there is sent the document so it picks up where the others left off.
+// Callers must hold the room's lock.
+func (h *Hub) mergeState(code string, doc *Document) error {
+	if doc.empty() {
+		return nil
+	}
+	room, err := h.store.LoadRoom(code)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	changed := false
+	for key, e := range doc.Entries {
+		if room.State != nil && room.State.Entries[key].Version >= e.Version {
+			continue
+		}
+		h.applyState(room, stateChange{Key: key, Entry: e}, "")
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return h.store.SaveRoom(room)
+}
+
+// event is the EventStateChanged announcing c in room code
+func (c stateChange) event(code string) SignalMessage {
+	msg := SignalMessage{Code: code, Type: EventStateChanged}
+	msg.Data, _ = json.Marshal(c)
+	return msg
+}
+
+// coalesceState drops queued, not yet delivered notifications about key;
+// only the latest value matters to a device catching up
+func (p *Peer) coalesceState(key string) {
+	kept := p.Queue[:0]
+	for _, q := range p.Queue {
+		if q.Msg.Type == EventStateChanged && q.Delivered.IsZero() && stateKey(q.Msg) == key {
+			continue
+		}
+		kept = append(kept, q)
+	}
+	p.Queue = kept
+}
+
+// stateKey extracts the key an EventStateChanged is about
+func stateKey(msg SignalMessage) string {
+	var data struct {
+		Key string `json:"key"`
+	}
+	_ = json.Unmarshal(msg.Data, &data)
+	return data.Key
+}
+
+func (h *Hub) handleState(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		doc, err := h.State(peerToken(r))
+		if err != nil {
+			h.httpError(w, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(doc)
+	case http.MethodPost:
+		var req struct {
+			Key       string          `json:"key"`
+			Value     json.RawMessage `json:"value"`
+			IfVersion *uint64         `json:"ifVersion,omitempty"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(h.cfg.Limits.MaxStateBytes)+1024)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		version, err := h.SetState(peerToken(r), req.Key, req.Value, req.IfVersion)
+		if err != nil {
+			h.httpError(w, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "version": version})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
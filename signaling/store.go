@@ -0,0 +1,204 @@
+package signaling
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNotFound is returned by a Store for unknown rooms and tokens
+var ErrNotFound = errors.New("not found")
+
+// Store keeps signaling rooms between requests. The Hub loads a room,
+// changes it and saves it back while holding its own lock, so a Store only
+// has to make each individual call safe for concurrent use.
+type Store interface {
+	// LoadRoom returns the room with code, or ErrNotFound
+	LoadRoom(code string) (*Room, error)
+	// SaveRoom stores room, replacing any previous version and its tokens
+	SaveRoom(room *Room) error
+	// DeleteRoom forgets the room with code and every token in it
+	DeleteRoom(code string) error
+	// LookupToken returns the code of the room a peer token belongs to, or ErrNotFound
+	LookupToken(token string) (string, error)
+	// Rooms lists the codes of every stored room
+	Rooms() ([]string, error)
+
+	// SaveDevice registers d, replacing any earlier registration of its ID
+	SaveDevice(d *Device) error
+	// LoadDevice returns the device with id, or ErrNotFound
+	LoadDevice(id string) (*Device, error)
+	// SavePairing records that devices a and b are paired, in either order
+	SavePairing(a, b string) error
+	// DeletePairing forgets the pairing of a and b, if any
+	DeletePairing(a, b string) error
+	// Pairings lists the IDs of every device paired with id
+	Pairings(id string) ([]string, error)
+}
+
+// memoryShards is how many independently locked partitions a MemoryStore
+// spreads rooms and tokens across
+const memoryShards = 64
+
+// MemoryStore is the default Store; rooms are lost when the process exits.
+// Rooms and tokens are sharded so unrelated rooms do not contend.
+type MemoryStore struct {
+	rooms  [memoryShards]roomShard
+	tokens [memoryShards]tokenShard
+
+	// the device registry is small and rarely written, so one lock will do
+	devMu    sync.RWMutex
+	devices  map[string]*Device
+	pairings map[string]map[string]bool // device ID -> paired device IDs
+}
+
+type roomShard struct {
+	mu     sync.RWMutex
+	rooms  map[string]*Room
+	tokens map[string][]string // room code -> tokens indexed at last save
+}
+
+type tokenShard struct {
+	mu    sync.RWMutex
+	codes map[string]string // token -> room code
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		devices:  make(map[string]*Device),
+		pairings: make(map[string]map[string]bool),
+	}
+	for i := range s.rooms {
+		s.rooms[i].rooms = make(map[string]*Room)
+		s.rooms[i].tokens = make(map[string][]string)
+		s.tokens[i].codes = make(map[string]string)
+	}
+	return s
+}
+
+func (s *MemoryStore) LoadRoom(code string) (*Room, error) {
+	rs := s.roomShard(code)
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	room, ok := rs.rooms[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return room, nil
+}
+
+func (s *MemoryStore) SaveRoom(room *Room) error {
+	rs := s.roomShard(room.Code)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s.forgetTokens(rs, room.Code)
+	rs.rooms[room.Code] = room
+	indexed := make([]string, 0, len(room.Peers))
+	for _, p := range room.Peers {
+		ts := s.tokenShard(p.Token)
+		ts.mu.Lock()
+		ts.codes[p.Token] = room.Code
+		ts.mu.Unlock()
+		indexed = append(indexed, p.Token)
+	}
+	rs.tokens[room.Code] = indexed
+	return nil
+}
+
+func (s *MemoryStore) DeleteRoom(code string) error {
+	rs := s.roomShard(code)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s.forgetTokens(rs, code)
+	delete(rs.rooms, code)
+	return nil
+}
+
+func (s *MemoryStore) LookupToken(token string) (string, error) {
+	ts := s.tokenShard(token)
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	code, ok := ts.codes[token]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return code, nil
+}
+
+func (s *MemoryStore) Rooms() ([]string, error) {
+	var codes []string
+	for i := range s.rooms {
+		rs := &s.rooms[i]
+		rs.mu.RLock()
+		for code := range rs.rooms {
+			codes = append(codes, code)
+		}
+		rs.mu.RUnlock()
+	}
+	return codes, nil
+}
+
+func (s *MemoryStore) roomShard(code string) *roomShard {
+	return &s.rooms[shardOf(code, memoryShards)]
+}
+
+func (s *MemoryStore) tokenShard(token string) *tokenShard {
+	return &s.tokens[shardOf(token, memoryShards)]
+}
+
+// forgetTokens drops every token indexed for room code. Callers must hold rs.mu.
+func (s *MemoryStore) forgetTokens(rs *roomShard, code string) {
+	for _, token := range rs.tokens[code] {
+		ts := s.tokenShard(token)
+		ts.mu.Lock()
+		delete(ts.codes, token)
+		ts.mu.Unlock()
+	}
+	delete(rs.tokens, code)
+}
+
+func (s *MemoryStore) SaveDevice(d *Device) error {
+	s.devMu.Lock()
+	defer s.devMu.Unlock()
+	s.devices[d.ID] = d
+	return nil
+}
+
+func (s *MemoryStore) LoadDevice(id string) (*Device, error) {
+	s.devMu.RLock()
+	defer s.devMu.RUnlock()
+	d, ok := s.devices[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return d, nil
+}
+
+func (s *MemoryStore) SavePairing(a, b string) error {
+	s.devMu.Lock()
+	defer s.devMu.Unlock()
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		if s.pairings[pair[0]] == nil {
+			s.pairings[pair[0]] = make(map[string]bool)
+		}
+		s.pairings[pair[0]][pair[1]] = true
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeletePairing(a, b string) error {
+	s.devMu.Lock()
+	defer s.devMu.Unlock()
+	delete(s.pairings[a], b)
+	delete(s.pairings[b], a)
+	return nil
+}
+
+func (s *MemoryStore) Pairings(id string) ([]string, error) {
+	s.devMu.RLock()
+	defer s.devMu.RUnlock()
+	ids := []string{}
+	for other := range s.pairings[id] {
+		ids = append(ids, other)
+	}
+	return ids, nil
+}
@@ -0,0 +1,110 @@
+package signaling
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"log"
+	"net"
+)
+
+// STUN message constants from RFC 5389
+const (
+	stunHeaderLen       = 20
+	stunMagicCookie     = 0x2112A442
+	stunBindingRequest  = 0x0001
+	stunBindingSuccess  = 0x0101
+	stunXORMappedAddr   = 0x0020
+	stunSoftware        = 0x8022
+	stunFingerprint     = 0x8028
+	stunFingerprintXOR  = 0x5354554e
+	stunSoftwareName    = "nebulink"
+	stunMaxRequestBytes = 1500
+)
+
+// ServeSTUN answers STUN Binding requests on conn with the address they came
+// from, so browsers can learn their server-reflexive candidate without a
+// separate STUN deployment. Anything else is ignored. It returns when conn
+// is closed.
+func ServeSTUN(conn net.PacketConn, logger *log.Logger) error {
+	buf := make([]byte, stunMaxRequestBytes)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		udp, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		resp := stunBindingResponse(buf[:n], udp)
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			logger.Println("stun: reply to", addr, "failed:", err)
+		}
+	}
+}
+
+// stunBindingResponse builds the success response to req, or returns nil if
+// req is not a well-formed Binding request
+func stunBindingResponse(req []byte, from *net.UDPAddr) []byte {
+	if len(req) < stunHeaderLen || req[0]&0xC0 != 0 {
+		return nil
+	}
+	if binary.BigEndian.Uint16(req[0:2]) != stunBindingRequest ||
+		binary.BigEndian.Uint32(req[4:8]) != stunMagicCookie {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(req[2:4]))
+	if length%4 != 0 || stunHeaderLen+length != len(req) {
+		return nil
+	}
+	txID := req[8:20]
+
+	// XOR-MAPPED-ADDRESS: the port is XORed with the top half of the magic
+	// cookie, an IPv4 address with the cookie, an IPv6 one with cookie+txID
+	ip := from.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = from.IP.To16()
+		family = 0x02
+	}
+	key := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+	key = append(key, txID...)
+	mapped := []byte{0, family, 0, 0}
+	binary.BigEndian.PutUint16(mapped[2:], uint16(from.Port)^(stunMagicCookie>>16))
+	for i, b := range ip {
+		mapped = append(mapped, b^key[i])
+	}
+
+	msg := make([]byte, stunHeaderLen, 64)
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingSuccess)
+	binary.BigEndian.PutUint32(msg[4:8], stunMagicCookie)
+	copy(msg[8:20], txID)
+	msg = stunAppendAttr(msg, stunXORMappedAddr, mapped)
+	msg = stunAppendAttr(msg, stunSoftware, []byte(stunSoftwareName))
+
+	// FINGERPRINT covers everything before it, with the length in the
+	// header already counting the fingerprint attribute itself
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-stunHeaderLen+8))
+	crc := crc32.ChecksumIEEE(msg) ^ stunFingerprintXOR
+	return stunAppendAttr(msg, stunFingerprint, binary.BigEndian.AppendUint32(nil, crc))
+}
+
+// stunAppendAttr appends a type-length-value attribute padded to 4 bytes and
+// updates the message length in the header
+func stunAppendAttr(msg []byte, typ uint16, value []byte) []byte {
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(value)))
+	msg = append(msg, value...)
+	for len(msg)%4 != 0 {
+		msg = append(msg, 0)
+	}
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-stunHeaderLen))
+	return msg
+}
@@ -0,0 +1,161 @@
+package signaling
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// stunRequest is a Binding request with no attributes and the transaction
+// ID of the RFC 5769 sample messages
+var stunRequest = []byte{
+	0x00, 0x01, 0x00, 0x00, // Binding request, no attributes
+	0x21, 0x12, 0xa4, 0x42, // magic cookie
+	0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae, // transaction ID
+}
+
+// stunAttrs checks the header and FINGERPRINT of a Binding success response
+// to stunRequest and returns its attributes by type
+func stunAttrs(t *testing.T, resp []byte) map[uint16][]byte {
+	t.Helper()
+	if len(resp) < stunHeaderLen || int(binary.BigEndian.Uint16(resp[2:4])) != len(resp)-stunHeaderLen {
+		t.Fatalf("bad response length: % x", resp)
+	}
+	if !bytes.Equal(resp[0:2], []byte{0x01, 0x01}) || !bytes.Equal(resp[4:20], stunRequest[4:20]) {
+		t.Fatalf("response header % x does not answer the request", resp[:stunHeaderLen])
+	}
+	attrs := make(map[uint16][]byte)
+	var last uint16
+	for rest := resp[stunHeaderLen:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			t.Fatalf("truncated attribute: % x", rest)
+		}
+		typ, n := binary.BigEndian.Uint16(rest[0:2]), int(binary.BigEndian.Uint16(rest[2:4]))
+		padded := 4 + (n+3)/4*4
+		if len(rest) < padded {
+			t.Fatalf("attribute %#04x overruns the message", typ)
+		}
+		if typ == stunFingerprint {
+			covered := resp[:len(resp)-len(rest)]
+			if want := crc32.ChecksumIEEE(covered) ^ stunFingerprintXOR; binary.BigEndian.Uint32(rest[4:8]) != want {
+				t.Errorf("FINGERPRINT %x, want %08x", rest[4:8], want)
+			}
+		}
+		attrs[typ] = rest[4 : 4+n]
+		last = typ
+		rest = rest[padded:]
+	}
+	if last != stunFingerprint {
+		t.Errorf("last attribute is %#04x, want FINGERPRINT", last)
+	}
+	return attrs
+}
+
+func TestSTUNBindingResponse(t *testing.T) {
+	// the mapped addresses and their XORed encodings from RFC 5769 2.2, 2.3
+	tests := []struct {
+		name   string
+		from   *net.UDPAddr
+		mapped []byte
+	}{
+		{"IPv4", &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 32853}, []byte{
+			0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43,
+		}},
+		{"IPv6", &net.UDPAddr{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 32853}, []byte{
+			0x00, 0x02, 0xa1, 0x47,
+			0x01, 0x13, 0xa9, 0xfa, 0xa5, 0xd3, 0xf1, 0x79,
+			0xbc, 0x25, 0xf4, 0xb5, 0xbe, 0xd2, 0xb9, 0xd9,
+		}},
+	}
+	for _, tt := range tests {
+		resp := stunBindingResponse(stunRequest, tt.from)
+		if resp == nil {
+			t.Errorf("%s: no response", tt.name)
+			continue
+		}
+		attrs := stunAttrs(t, resp)
+		if got := attrs[stunXORMappedAddr]; !bytes.Equal(got, tt.mapped) {
+			t.Errorf("%s: XOR-MAPPED-ADDRESS % x, want % x", tt.name, got, tt.mapped)
+		}
+		if got := string(attrs[stunSoftware]); got != stunSoftwareName {
+			t.Errorf("%s: SOFTWARE %q", tt.name, got)
+		}
+	}
+}
+
+func TestSTUNRejects(t *testing.T) {
+	with := func(change func([]byte) []byte) []byte {
+		return change(bytes.Clone(stunRequest))
+	}
+	tests := []struct {
+		name string
+		req  []byte
+	}{
+		{"empty", nil},
+		{"short header", stunRequest[:stunHeaderLen-1]},
+		{"binding success", with(func(b []byte) []byte { b[1] = 0x01; b[0] = 0x01; return b })},
+		{"binding indication", with(func(b []byte) []byte { b[1] = 0x11; return b })},
+		{"allocate request", with(func(b []byte) []byte { b[1] = 0x03; return b })},
+		{"not STUN", with(func(b []byte) []byte { b[0] = 0x80; return b })},
+		{"no magic cookie", with(func(b []byte) []byte { b[4] = 0; return b })},
+		{"length past the end", with(func(b []byte) []byte { b[3] = 4; return b })},
+		{"unpadded length", with(func(b []byte) []byte { b[3] = 3; return append(b, 0, 0, 0) })},
+		{"trailing bytes", append(bytes.Clone(stunRequest), 0, 0, 0, 0)},
+	}
+	from := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 32853}
+	for _, tt := range tests {
+		if resp := stunBindingResponse(tt.req, from); resp != nil {
+			t.Errorf("%s: answered with % x", tt.name, resp)
+		}
+	}
+}
+
+func TestServeSTUN(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- ServeSTUN(conn, log.New(io.Discard, "", 0)) }()
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// garbage first: it must be dropped without stopping the server
+	if _, err := client.WriteTo([]byte("hello"), conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo(stunRequest, conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, stunMaxRequestBytes)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := stunAttrs(t, buf[:n])[stunXORMappedAddr]
+	if len(mapped) != 8 || mapped[1] != 0x01 {
+		t.Fatalf("XOR-MAPPED-ADDRESS % x is not IPv4", mapped)
+	}
+	port := int(binary.BigEndian.Uint16(mapped[2:4]) ^ stunMagicCookie>>16)
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(mapped[4:8])^stunMagicCookie)
+	local := client.LocalAddr().(*net.UDPAddr)
+	if !ip.Equal(local.IP) || port != local.Port {
+		t.Errorf("mapped %s:%d, want %s", ip, port, local)
+	}
+
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServeSTUN after close: %v", err)
+	}
+}
@@ -2,14 +2,18 @@ import {LoggerWithoutDebug, Wllama} from "/static/wllama/esm/index.js";
 
 class MastodonAccount {
     constructor({
-                    id, name, accountName, image, token, instance, isActive = 0, topics = [],
+                    id, name, accountName, image, token, session = null, instance, server = null, isActive = 0, topics = [],
                 }) {
         this.id = id;
         this.name = name;
         this.accountName = accountName;
         this.image = image;
         this.token = token;
+        // in server session mode token is null and session names the login on the server
+        this.session = session;
         this.instance = instance.replace(/\/+$/, "");
+        // what the server found out about the instance: software, version, max_characters, ...
+        this.server = server;
         this.isActive = isActive ? 1 : 0; // Store as 1/0 for IndexedDB compatibility
         this.topics = Array.isArray(topics) ? topics.slice(0, 20) : [];
         this.updatedAt = new Date().toISOString();
@@ -23,7 +27,9 @@ class MastodonAccount {
             accountName: this.accountName,
             image: this.image,
             token: this.token,
+            session: this.session,
             instance: this.instance,
+            server: this.server,
             isActive: this.isActive,
             topics: this.topics || [],
             updatedAt: this.updatedAt,
@@ -38,7 +44,9 @@ class MastodonAccount {
             accountName: data.accountName,
             image: data.image,
             token: data.token,
+            session: data.session || null,
             instance: data.instance,
+            server: data.server || null,
             isActive: data.isActive || 0,
             topics: data.topics || [],
         });
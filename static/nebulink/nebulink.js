@@ -49,6 +49,18 @@ const apiURLs = {
     search: "/api/v2/search?q={0}&type=statuses",
     search_hashtags: "/api/v2/search?q={0}&type=hashtags",
 };
+// call the Mastodon API at url (on account's instance) as account: with its
+// token, or through the server's session proxy when the token stays there
+function mastodonFetch(url, account, init = {}) {
+    if (account?.session && url.startsWith(account.instance + "/")) {
+        return fetch(`/api/mastodon/${account.session}` + url.slice(account.instance.length), init);
+    }
+    if (account?.token) {
+        init = {...init, headers: {...init.headers, Authorization: `Bearer ${account.token}`}};
+    }
+    return fetch(url, init);
+}
+
 let nsfwWords = ["nsfw", "18+", "explicit", "lewd", "adult", "topless", "nude", "naked", "tits", "tiddies", "boobs", "sex", "booty", "ass", "porn"];
 let max_id = null; //cursor for fetching timeline
 let isLoadingMore = false;
@@ -265,6 +277,10 @@ async function init() {
     db.version(3).stores({
         accounts: "++autoId, id, instance, isActive, updatedAt", settings: "key",
     });
+    // our WebRTC device identity (id "self") and the devices paired with it
+    db.version(4).stores({
+        accounts: "++autoId, id, instance, isActive, updatedAt", settings: "key", webrtcDevices: "id",
+    });
 
     await db.open();
 
@@ -358,6 +374,8 @@ async function init() {
     }
 
     await resetGUI(false);
+
+    await webrtcJoinFromLink();
 }
 
 init();
@@ -379,10 +397,8 @@ async function removeNSFWFilter() {
     }
     try {
         // Step 1: Get all filters
-        const filtersResponse = await fetch(currentAccount.instance + "/api/v2/filters", {
-            method: "GET", headers: {
-                "Authorization": `Bearer ${currentAccount.token}`
-            }
+        const filtersResponse = await mastodonFetch(currentAccount.instance + "/api/v2/filters", currentAccount, {
+            method: "GET",
         });
 
         const filters = await filtersResponse.json();
@@ -394,10 +410,8 @@ async function removeNSFWFilter() {
         }
 
         // Step 2: Delete the filter
-        await fetch(`${currentAccount.instance}/api/v2/filters/${nsfwFilter.id}`, {
-            method: "DELETE", headers: {
-                "Authorization": `Bearer ${currentAccount.token}`
-            }
+        await mastodonFetch(`${currentAccount.instance}/api/v2/filters/${nsfwFilter.id}`, currentAccount, {
+            method: "DELETE",
         });
 
         console.log("NSFW Filter removed successfully.");
@@ -420,9 +434,9 @@ async function createNSFWFilter() {
 
     try {
         // Step 1: Create the filter
-        const filterResponse = await fetch(currentAccount.instance + "/api/v2/filters", {
+        const filterResponse = await mastodonFetch(currentAccount.instance + "/api/v2/filters", currentAccount, {
             method: "POST", headers: {
-                "Authorization": `Bearer ${currentAccount.token}`, "Content-Type": "application/json"
+                "Content-Type": "application/json"
             }, body: JSON.stringify(filterPayload)
         });
 
@@ -431,9 +445,9 @@ async function createNSFWFilter() {
 
         // Step 2: Add keywords to the filter
         for (const keyword of keywords) {
-            await fetch(`${currentAccount.instance}/api/v2/filters/${filterId}/keywords`, {
+            await mastodonFetch(`${currentAccount.instance}/api/v2/filters/${filterId}/keywords`, currentAccount, {
                 method: "POST", headers: {
-                    "Authorization": `Bearer ${currentAccount.token}`, "Content-Type": "application/json"
+                    "Content-Type": "application/json"
                 }, body: JSON.stringify({
                     keyword, whole_word: false
                 })
@@ -454,7 +468,7 @@ document.getElementById("feed-section").addEventListener("scroll", async () => {
     const scrollPosition = document.getElementById("feed-section").scrollTop + document.getElementById("feed-section").clientHeight;
     const threshold = document.getElementById("feed-section").scrollHeight - 100;
 
-    if (scrollPosition >= threshold && max_id && currentAccount?.instance && currentAccount?.token) {
+    if (scrollPosition >= threshold && max_id && currentAccount?.instance && (currentAccount?.token || currentAccount?.session)) {
         isLoadingMore = true;
 
         await updateTimeline(false);
@@ -696,7 +710,9 @@ document
             });
 
             if (!resp.ok) {
-                throw new Error(`Server returned error: ${resp.status}`);
+                // the server explains why it will not log in to an instance
+                const reason = (await resp.text()).trim();
+                throw new Error(reason || `Server returned error: ${resp.status}`);
             }
             const json = await resp.json();
             if (json.authorize_url) {
@@ -715,14 +731,16 @@ document
                 channel.onmessage = async (event) => {
                     // window.addEventListener("message", async (event) => {
                     if (event.origin !== window.location.origin) return;
-                    if (event.data.type === "oauth_token") {
-                        const token = event.data.access_token;
+                    if (event.data.type === "oauth_token" || event.data.type === "oauth_session") {
+                        // oauth_session: the server kept the token and only tells us which login it is
+                        const token = event.data.access_token || null;
+                        const session = event.data.account || null;
                         const instance = "https://" + instanceHost;
 
                         // Fetch account info from Mastodon
                         try {
-                            const accountResp = await fetch(instance + "/api/v1/accounts/verify_credentials", {
-                                headers: {Authorization: `Bearer ${token}`},
+                            const accountResp = await mastodonFetch(instance + "/api/v1/accounts/verify_credentials", {
+                                token, session, instance,
                             });
 
                             if (accountResp.ok) {
@@ -749,7 +767,9 @@ document
                                     accountName: "@" + accountData.acct,
                                     image: accountData.avatar,
                                     token: token,
+                                    session: session,
                                     instance: instance,
+                                    server: json.server,
                                     isActive: 1,
                                 });
 
@@ -808,9 +828,34 @@ document
         document.getElementById("account-dialog").close();
     });
 
-// Logout handler for Mastodon (client-only)
+// Ask the server to revoke an account's access token at its instance;
+// resolves to whether the instance accepted
+async function revokeMastodonAccount(account) {
+    try {
+        const resp = await fetch("/logout", {
+            method: "POST",
+            headers: {"Content-Type": "application/json"},
+            body: JSON.stringify(account.session
+                ? {account: account.session}
+                : {instance: new URL(account.instance).host, token: account.token}),
+        });
+        if (!resp.ok) return false;
+        const json = await resp.json();
+        return json.revoked === true;
+    } catch (e) {
+        console.warn("revokeMastodonAccount failed", e);
+        return false;
+    }
+}
+
+// Logout handler for Mastodon
 async function logoutMastodon() {
     try {
+        const accounts = await db.table("accounts").toArray();
+        const revoked = await Promise.all(accounts.map(revokeMastodonAccount));
+        if (revoked.includes(false)) {
+            console.log("Some tokens could not be revoked. To fully revoke access, remove Nebulink from your Mastodon account's authorized apps.");
+        }
         await db.table("accounts").clear();
     } catch (_) {
     }
@@ -821,10 +866,6 @@ async function logoutMastodon() {
     document.getElementById("feed-items").innerHTML = "";
     document.getElementById("toot-section").innerHTML = "";
     document.getElementById("instance-input")?.focus();
-    try {
-        console.log("Logged out locally. To fully revoke access, remove Nebulink from your Mastodon account's authorized apps.");
-    } catch (_) {
-    }
     // Ensure user has provided favorite topics for recommendation filtering
     try {
         await ensureTopicsForCurrentAccount();
@@ -1022,6 +1063,10 @@ async function logoutAccount(accountId) {
     }
 
     try {
+        const account = await db.accounts.get(accountId);
+        if (account && !(await revokeMastodonAccount(account))) {
+            console.log("Could not revoke the access token. To fully revoke access, remove Nebulink from your Mastodon account's authorized apps.");
+        }
         await db.accounts.delete(accountId);
 
         // If this was the active account, activate another one
@@ -1053,8 +1098,8 @@ async function loadFollowers() {
             containerFooter.innerHTML = "";
             return;
         }
-        const r = await fetch(currentAccount.instance + `/api/v1/accounts/${currentAccount.id}/following `, {
-            method: "GET", headers: {Authorization: `Bearer ${currentAccount.token}`},
+        const r = await mastodonFetch(currentAccount.instance + `/api/v1/accounts/${currentAccount.id}/following`, currentAccount, {
+            method: "GET",
         });
         if (r.ok) {
             // const linkHeader = r.headers.get('Link');
@@ -1107,8 +1152,8 @@ async function loadHashtags() {
             containerFooter.innerHTML = "";
             return;
         }
-        const r = await fetch(currentAccount.instance + `/api/v1/followed_tags`, {
-            method: "GET", headers: {Authorization: `Bearer ${currentAccount.token}`},
+        const r = await mastodonFetch(currentAccount.instance + `/api/v1/followed_tags`, currentAccount, {
+            method: "GET",
         });
         if (r.ok) {
             // const linkHeader = r.headers.get('Link');
@@ -1162,8 +1207,8 @@ async function searchHashtag() {
             return;
         }
         let url = currentAccount.instance + apiURLs[currentMode.type].replace("{0}", currentMode.modifier)
-        const r = await fetch(url, {
-            method: "GET", headers: {Authorization: `Bearer ${currentAccount.token}`},
+        const r = await mastodonFetch(url, currentAccount, {
+            method: "GET",
         });
         if (r.ok) {
             let result = await r.json();
@@ -1227,11 +1272,10 @@ async function updateTimeline(doReset = true) {
 
 
         const instance = currentAccount?.instance || null;
-        const token = currentAccount?.token || null;
         const apiUrl = currentMode.modifier ? apiURLs[currentMode.type].replace("{0}", currentMode.modifier) : apiURLs[currentMode.type];
 
         ProgressManager.set(50)
-        await loadTimelineForInstance(instance, token, apiUrl);
+        await loadTimelineForInstance(instance, currentAccount, apiUrl);
         ProgressManager.finish();
 
         if (max_id) {
@@ -1395,7 +1439,7 @@ async function renderStatuses(statuses) {
         }
 
         const commentCountEl = node.querySelector(".status-comments-count");
-        addToCommentsQueue(currentAccount ? currentAccount.instance : null, s, currentAccount ? currentAccount.token : null, (a) => {
+        addToCommentsQueue(currentAccount ? currentAccount.instance : null, s, currentAccount, (a) => {
             s.comments = a;
             if (commentCountEl) {
                 commentCountEl.textContent = s.comments ? s.comments.length : 0;
@@ -1502,8 +1546,8 @@ window.addEventListener("popstate", () => {
 
 async function getTranslationFromMastodon(s) {
     try {
-        const r = await fetch(currentAccount.instance + `/api/v1/statuses/${s.id}/translate`, {
-            method: "POST", headers: {Authorization: `Bearer ${currentAccount.token}`},
+        const r = await mastodonFetch(currentAccount.instance + `/api/v1/statuses/${s.id}/translate`, currentAccount, {
+            method: "POST",
         });
         if (r.ok) {
             const json = await r.json();
@@ -1897,10 +1941,8 @@ function updateFavouriteState(id, favourited) {
     ///api/v1/statuses/:id/unfavourite
     const action = favourited ? "favourite" : "unfavourite";
     const url = `${currentAccount.instance}/api/v1/statuses/${id}/${action}`;
-    return fetch(url, {
-        method: "POST", headers: {
-            Authorization: `Bearer ${currentAccount.token}`,
-        },
+    return mastodonFetch(url, currentAccount, {
+        method: "POST",
     });
 }
 
@@ -1935,18 +1977,13 @@ function showSummary(text) {
     }
 }
 
-async function getComments(domain, status, access) {
+async function getComments(domain, status, account) {
     if (!domain) {
         domain = "https://mastodon.social";
     }
 
-    let headers = {};
-    if (access) {
-        headers["Authorization"] = `Bearer ${access}`;
-    }
-
-    const r = await fetch(domain + `/api/v1/statuses/${status.id}/context`, {
-        method: "GET", headers: headers,
+    const r = await mastodonFetch(domain + `/api/v1/statuses/${status.id}/context`, account, {
+        method: "GET",
     });
     if (!r.ok) {
         console.log("failed");
@@ -1956,7 +1993,7 @@ async function getComments(domain, status, access) {
     return rs.descendants;
 }
 
-async function loadTimelineForInstance(domain, access, apiURL, tryCount = 0) {
+async function loadTimelineForInstance(domain, account, apiURL, tryCount = 0) {
     // if (!domain) return;
     let url = domain + apiURL;
     if (!domain) {
@@ -1973,13 +2010,8 @@ async function loadTimelineForInstance(domain, access, apiURL, tryCount = 0) {
     } else {
         document.getElementById("feed-items").innerHTML = "";
     }
-    const headers = {};
-    if (access) {
-        headers["Authorization"] = `Bearer ${access}`;
-    }
-
-    const r = await fetch(url, {
-        method: "GET", headers: headers,
+    const r = await mastodonFetch(url, account, {
+        method: "GET",
     });
     if (!r.ok) {
         console.log("failed");
@@ -2069,7 +2101,7 @@ async function loadTimelineForInstance(domain, access, apiURL, tryCount = 0) {
 
     offset += statuses.length;
     if ((thisRenderedStatuses.length === 0 || currentStatuses.length < statuses.length) && statuses.length >= 20 && tryCount <= 3) {
-        await loadTimelineForInstance(domain, access, apiURL, ++tryCount);
+        await loadTimelineForInstance(domain, account, apiURL, ++tryCount);
     }
 
     if (currentStatuses.length === 0) {
@@ -2638,34 +2670,309 @@ function initNavigation() {
 
 // -------------------- WebRTC signaling (polling-based) --------------------
 const webrtcSignal = {
-    pc: null, dc: null, code: null, name: null, ip: null, polling: false, pollHandle: null, pendingCandidates: [],
+    pc: null, dc: null, code: null, name: null, sameNetwork: [], token: null, host: null, lastSeq: 0, state: {version: 0, entries: {}}, iceServers: null, remote: null, relay: false, polling: false, pollHandle: null, pendingCandidates: [],
 };
 
-async function webrtcJoin(code, name, ip) {
+// codes are typed by hand: the server ignores case, spaces and dashes, and so do we
+function webrtcNormalizeCode(code) {
+    return code.startsWith("device:") ? code : code.replace(/[\s-]/g, "").toUpperCase();
+}
+
+async function webrtcJoin(code, name) {
+    code = webrtcNormalizeCode(code);
+    // rejoining the same room under the same name resumes our old seat
+    const token = webrtcSignal.code === code && webrtcSignal.name === name ? webrtcSignal.token : null;
     webrtcSignal.code = code;
     webrtcSignal.name = name;
-    webrtcSignal.ip = ip || null;
     try {
-        await fetch("/webrtc/join", {
-            method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify({code, name, ip}),
+        const r = await fetch("/webrtc/join", {
+            method: "POST", headers: {"Content-Type": "application/json"},
+            body: JSON.stringify({code, name, token, onConflict: "suffix"}),
         });
+        if (r.ok) {
+            const joined = await r.json();
+            webrtcSignal.code = joined.code;
+            webrtcSignal.token = joined.token;
+            webrtcSignal.name = joined.name;
+            webrtcSignal.host = joined.host;
+            // peers behind our public address are likely on the same LAN,
+            // where host candidates should connect without STUN/TURN
+            webrtcSignal.sameNetwork = joined.sameNetwork || [];
+            // a resumed seat keeps its sequence numbers and unacknowledged
+            // queue on the server, so only a fresh one starts counting again
+            if (joined.token !== token) webrtcSignal.lastSeq = 0;
+            webrtcSignal.iceServers = joined.iceServers || null;
+        }
     } catch (e) {
         console.warn("webrtc join failed", e);
     }
     if (!webrtcSignal.polling) startPollingSignals();
 }
 
+// a pairing link or scanned QR code opens the page with ?pair=CODE: join
+// that room straight away, then drop the parameter so a reload does not rejoin
+async function webrtcJoinFromLink() {
+    const url = new URL(window.location.href);
+    const code = url.searchParams.get("pair");
+    if (!code) return;
+    url.searchParams.delete("pair");
+    history.replaceState(history.state, "", url);
+    await joinCall(code, features.device || "device");
+}
+
+// host a room under a server-issued pairing code; returns {code, url, expires}
+// so the code can be shown, or /webrtc/pair/qr?code=... scanned by the other device
+async function webrtcPair(name) {
+    webrtcSignal.name = name;
+    webrtcSignal.sameNetwork = [];
+    try {
+        const r = await fetch("/webrtc/pair", {
+            method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify({name}),
+        });
+        if (!r.ok) return null;
+        const paired = await r.json();
+        webrtcSignal.code = paired.code;
+        webrtcSignal.token = paired.token;
+        webrtcSignal.host = name;
+        webrtcSignal.lastSeq = 0;
+        await fetchIceServers();
+        if (!webrtcSignal.polling) startPollingSignals();
+        return {code: paired.code, url: paired.url, expires: paired.expires};
+    } catch (e) {
+        console.warn("webrtc pair failed", e);
+        return null;
+    }
+}
+
+// STUN/TURN servers (with short-lived TURN credentials) for the joined room
+async function fetchIceServers() {
+    try {
+        const r = await fetch("/webrtc/ice-servers", {headers: {"X-Peer-Token": webrtcSignal.token}});
+        if (r.ok) webrtcSignal.iceServers = (await r.json()).iceServers;
+    } catch (e) {
+        console.warn("fetching ice servers failed", e);
+    }
+}
+
+// shared room state, e.g. the open toot, so another device can resume from it
+async function webrtcGetState() {
+    if (!webrtcSignal.token) return null;
+    try {
+        const r = await fetch("/webrtc/state", {headers: {"X-Peer-Token": webrtcSignal.token}});
+        if (r.ok) webrtcSignal.state = await r.json();
+    } catch (e) {
+        console.warn("webrtc state fetch failed", e);
+    }
+    return webrtcSignal.state;
+}
+
+// write key; pass ifVersion (0 for "not set yet") to only write over what we last saw.
+// returns false on a version conflict, after which webrtcGetState() has the latest
+async function webrtcSetState(key, value, ifVersion) {
+    if (!webrtcSignal.token) return false;
+    try {
+        const r = await fetch("/webrtc/state", {
+            method: "POST", headers: {"Content-Type": "application/json", "X-Peer-Token": webrtcSignal.token},
+            body: JSON.stringify({key, value, ifVersion}),
+        });
+        return r.ok;
+    } catch (e) {
+        console.warn("webrtc state update failed", e);
+        return false;
+    }
+}
+
+// host only: remove another device from the room
+async function webrtcKick(name) {
+    if (!webrtcSignal.token) return;
+    try {
+        await fetch("/webrtc/kick", {
+            method: "POST", headers: {"Content-Type": "application/json", "X-Peer-Token": webrtcSignal.token},
+            body: JSON.stringify({name}),
+        });
+    } catch (e) {
+        console.warn("webrtc kick failed", e);
+    }
+}
+
+// host only: end the room for everyone, ourselves included (room-closed follows)
+async function webrtcCloseRoom() {
+    if (!webrtcSignal.token) return;
+    try {
+        await fetch("/webrtc/close", {method: "POST", headers: {"X-Peer-Token": webrtcSignal.token}});
+    } catch (e) {
+        console.warn("webrtc close failed", e);
+    }
+}
+
+// our Ed25519 identity, generated once; the private key never leaves IndexedDB
+async function webrtcIdentity() {
+    let self = await db.webrtcDevices.get("self");
+    if (!self) {
+        const keys = await crypto.subtle.generateKey({name: "Ed25519"}, false, ["sign", "verify"]);
+        self = {id: "self", keys, deviceId: null};
+        await db.webrtcDevices.put(self);
+    }
+    return self;
+}
+
+// fetch a fresh challenge and sign it for action on subject
+async function webrtcSignChallenge(keys, action, subject) {
+    const r = await fetch("/webrtc/devices/challenge");
+    if (!r.ok) return null;
+    const {challenge} = await r.json();
+    const text = `nebulink-device\n${action}\n${challenge}\n${subject}`;
+    const sig = await crypto.subtle.sign({name: "Ed25519"}, keys.privateKey, new TextEncoder().encode(text));
+    return {challenge, signature: btoa(String.fromCharCode(...new Uint8Array(sig)))};
+}
+
+// register this device in the pairing room we are in (one opened through
+// /webrtc/pair), pairing it with every device there that registered too;
+// later webrtcConnectDevice reaches them without a code
+async function webrtcRegisterDevice(name) {
+    if (!webrtcSignal.token) return null;
+    try {
+        const self = await webrtcIdentity();
+        const signed = await webrtcSignChallenge(self.keys, "register", webrtcSignal.code);
+        if (!signed) return null;
+        const publicKey = new Uint8Array(await crypto.subtle.exportKey("raw", self.keys.publicKey));
+        const r = await fetch("/webrtc/devices/register", {
+            method: "POST", headers: {"Content-Type": "application/json", "X-Peer-Token": webrtcSignal.token},
+            body: JSON.stringify({publicKey: btoa(String.fromCharCode(...publicKey)), name, ...signed}),
+        });
+        if (!r.ok) return null;
+        const registered = await r.json();
+        await db.webrtcDevices.update("self", {deviceId: registered.device.id});
+        for (const d of registered.paired) await db.webrtcDevices.put({id: d.id, name: d.name});
+        return registered.device.id;
+    } catch (e) {
+        console.warn("webrtc device registration failed", e);
+        return null;
+    }
+}
+
+// open the room we share with a paired device; it connects the same way
+async function webrtcConnectDevice(peerId) {
+    try {
+        const self = await webrtcIdentity();
+        if (!self.deviceId) return false;
+        const signed = await webrtcSignChallenge(self.keys, "connect", peerId);
+        if (!signed) return false;
+        const r = await fetch("/webrtc/devices/connect", {
+            method: "POST", headers: {"Content-Type": "application/json"},
+            body: JSON.stringify({device: self.deviceId, peer: peerId, ...signed}),
+        });
+        if (!r.ok) return false;
+        const joined = await r.json();
+        webrtcSignal.code = joined.code;
+        webrtcSignal.token = joined.token;
+        webrtcSignal.name = joined.name;
+        webrtcSignal.host = joined.host;
+        webrtcSignal.sameNetwork = joined.sameNetwork || [];
+        webrtcSignal.lastSeq = 0;
+        webrtcSignal.iceServers = joined.iceServers || null;
+        if (!webrtcSignal.polling) startPollingSignals();
+        return true;
+    } catch (e) {
+        console.warn("webrtc device connect failed", e);
+        return false;
+    }
+}
+
+async function webrtcUnpairDevice(peerId) {
+    try {
+        const self = await webrtcIdentity();
+        const signed = self.deviceId && await webrtcSignChallenge(self.keys, "unpair", peerId);
+        if (signed) {
+            await fetch("/webrtc/devices/unpair", {
+                method: "POST", headers: {"Content-Type": "application/json"},
+                body: JSON.stringify({device: self.deviceId, peer: peerId, ...signed}),
+            });
+        }
+    } catch (e) {
+        console.warn("webrtc unpair failed", e);
+    }
+    await db.webrtcDevices.delete(peerId);
+}
+
+// leave a file (e.g. an image or a draft) for the other devices in the room,
+// or only for `to`; works without a data channel and resumes after network hiccups
+async function webrtcDropFile(file, to) {
+    if (!webrtcSignal.token) return null;
+    const headers = {"X-Peer-Token": webrtcSignal.token};
+    try {
+        const r = await fetch("/webrtc/drops", {
+            method: "POST", headers: {...headers, "Content-Type": "application/json"},
+            body: JSON.stringify({name: file.name, type: file.type, size: file.size, to}),
+        });
+        if (!r.ok) return null;
+        const {id, chunk} = await r.json();
+        let offset = 0;
+        for (let failures = 0; offset < file.size && failures < 5;) {
+            try {
+                const up = await fetch(`/webrtc/drops/${id}?offset=${offset}`, {
+                    method: "PATCH", headers, body: file.slice(offset, offset + chunk),
+                });
+                if (up.ok) {
+                    offset = (await up.json()).offset;
+                    continue;
+                }
+                if (up.status !== 416) return null;
+            } catch (_) {
+            }
+            // ask the server how much arrived and carry on from there
+            failures++;
+            const status = await fetch(`/webrtc/drops/${id}?status`, {headers});
+            if (!status.ok) return null;
+            offset = (await status.json()).offset;
+        }
+        return offset === file.size ? id : null;
+    } catch (e) {
+        console.warn("webrtc file drop failed", e);
+        return null;
+    }
+}
+
+// download a drop announced by drop-ready; the server deletes it afterwards
+async function webrtcFetchDrop(drop) {
+    const parts = [];
+    let received = 0;
+    for (let attempt = 0; received < drop.size && attempt < 5; attempt++) {
+        try {
+            const r = await fetch(`/webrtc/drops/${drop.id}`, {
+                headers: {"X-Peer-Token": webrtcSignal.token, ...(received ? {"Range": `bytes=${received}-`} : {})},
+            });
+            if (!r.ok) break;
+            const reader = r.body.getReader();
+            for (; ;) {
+                const {done, value} = await reader.read();
+                if (done) break;
+                parts.push(value);
+                received += value.length;
+            }
+        } catch (_) {
+            // resume from what we already have
+        }
+    }
+    if (received !== drop.size) return null;
+    return new File(parts, drop.name, {type: drop.type || "application/octet-stream"});
+}
+
 async function webrtcLeave() {
-    if (!webrtcSignal.code || !webrtcSignal.name) return;
+    if (!webrtcSignal.token) return;
     try {
         await fetch("/webrtc/leave", {
-            method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify({
-                code: webrtcSignal.code, name: webrtcSignal.name,
-            }),
+            method: "POST", headers: {"Content-Type": "application/json", "X-Peer-Token": webrtcSignal.token},
         });
     } catch (e) {
         /* ignore */
     }
+    webrtcGone();
+}
+
+// forget the room we were in: our token is dead, so stop polling and hang up
+function webrtcGone() {
+    webrtcSignal.token = null;
     stopPollingSignals();
     if (webrtcSignal.pc) {
         try {
@@ -2675,6 +2982,8 @@ async function webrtcLeave() {
     }
     webrtcSignal.pc = null;
     webrtcSignal.dc = null;
+    webrtcSignal.relay = false;
+    webrtcSignal.remote = null;
 }
 
 function startPollingSignals(interval = 1500) {
@@ -2682,13 +2991,23 @@ function startPollingSignals(interval = 1500) {
     webrtcSignal.polling = true;
 
     async function pollOnce() {
-        if (!webrtcSignal.code || !webrtcSignal.name) return;
+        if (!webrtcSignal.token) return;
         try {
-            const q = `/webrtc/poll?code=${encodeURIComponent(webrtcSignal.code)}&name=${encodeURIComponent(webrtcSignal.name)}`;
-            const r = await fetch(q);
+            // acknowledge what we have handled so a lost response gets replayed
+            const token = webrtcSignal.token;
+            const r = await fetch(`/webrtc/poll?ack=${webrtcSignal.lastSeq}`, {headers: {"X-Peer-Token": token}});
+            // removed from the room (timed out, kicked or closed) and already told why
+            if (r.status === 401) {
+                if (webrtcSignal.token === token) webrtcGone();
+                return;
+            }
             if (!r.ok) return;
             const msgs = await r.json();
-            for (const m of msgs) handleSignalMessage(m);
+            for (const m of msgs) {
+                if (m.seq <= webrtcSignal.lastSeq) continue;
+                webrtcSignal.lastSeq = m.seq;
+                handleSignalMessage(m);
+            }
         } catch (e) {
             // ignore
         }
@@ -2707,12 +3026,12 @@ function stopPollingSignals() {
 }
 
 async function sendSignal(msg) {
-    if (!webrtcSignal.code || !webrtcSignal.name) return;
-    msg.code = webrtcSignal.code;
-    msg.from = webrtcSignal.name;
+    if (!webrtcSignal.token) return;
     try {
         await fetch("/webrtc/signal", {
-            method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify(msg),
+            method: "POST",
+            headers: {"Content-Type": "application/json", "X-Peer-Token": webrtcSignal.token},
+            body: JSON.stringify(msg),
         });
     } catch (e) {
         console.warn("sendSignal failed", e);
@@ -2721,7 +3040,7 @@ async function sendSignal(msg) {
 
 function createPeerConnection() {
     if (webrtcSignal.pc) return webrtcSignal.pc;
-    const config = {iceServers: [{urls: ["stun:stun.l.google.com:19302"]}]};
+    const config = {iceServers: webrtcSignal.iceServers || [{urls: ["stun:stun.l.google.com:19302"]}]};
     const pc = new RTCPeerConnection(config);
     pc.onicecandidate = (ev) => {
         if (ev.candidate) {
@@ -2730,28 +3049,52 @@ function createPeerConnection() {
     };
     pc.ondatachannel = (ev) => {
         webrtcSignal.dc = ev.channel;
-        webrtcSignal.dc.onmessage = (e) => console.log("webrtc data:", e.data);
+        webrtcSignal.dc.onmessage = (e) => webrtcOnData(e.data);
         webrtcSignal.dc.onopen = () => console.log("datachannel open");
     };
+    // no route between the devices (e.g. no TURN and both behind strict NATs):
+    // keep the same frames flowing through the server instead
+    pc.onconnectionstatechange = () => {
+        if (pc.connectionState === "failed" && !webrtcSignal.relay) {
+            console.warn("webrtc peer connection failed, relaying through the server");
+            webrtcSignal.relay = true;
+            stopPollingSignals();
+            startPollingSignals(250);
+        }
+    };
     webrtcSignal.pc = pc;
     return pc;
 }
 
-async function startCall(code, name, ip) {
-    await webrtcJoin(code, name, ip);
+async function startCall(code, name) {
+    await webrtcJoin(code, name);
     const pc = createPeerConnection();
     const dc = pc.createDataChannel("nebulink");
     webrtcSignal.dc = dc;
     dc.onopen = () => console.log("datachannel open");
-    dc.onmessage = (e) => console.log("webrtc data:", e.data);
+    dc.onmessage = (e) => webrtcOnData(e.data);
 
     const offer = await pc.createOffer();
     await pc.setLocalDescription(offer);
     await sendSignal({to: "", type: "offer", data: offer});
 }
 
-async function joinCall(code, name, ip) {
-    await webrtcJoin(code, name, ip);
+// send an application frame to the other device, over the data channel when
+// it is open and through the server relay otherwise
+async function webrtcSend(data) {
+    if (webrtcSignal.dc && webrtcSignal.dc.readyState === "open") {
+        webrtcSignal.dc.send(data);
+    } else if (webrtcSignal.relay && webrtcSignal.remote) {
+        await sendSignal({to: webrtcSignal.remote, type: "relay", data});
+    }
+}
+
+function webrtcOnData(data) {
+    console.log("webrtc data:", data);
+}
+
+async function joinCall(code, name) {
+    await webrtcJoin(code, name);
     // poll will deliver any existing offers; when offer arrives handleSignalMessage will create PC and answer
 }
 
@@ -2761,6 +3104,7 @@ async function handleSignalMessage(msg) {
             // incoming offer: create pc, setRemote, create answer
             const pc = createPeerConnection();
             const desc = msg.data;
+            webrtcSignal.remote = msg.from;
             await pc.setRemoteDescription(new RTCSessionDescription(desc));
             const answer = await pc.createAnswer();
             await pc.setLocalDescription(answer);
@@ -2768,8 +3112,14 @@ async function handleSignalMessage(msg) {
             await sendSignal({to: msg.from, type: "answer", data: answer});
         } else if (msg.type === "answer") {
             if (!webrtcSignal.pc) return;
+            webrtcSignal.remote = msg.from;
             await webrtcSignal.pc.setRemoteDescription(new RTCSessionDescription(msg.data));
             await flushPendingCandidates();
+        } else if (msg.type === "relay") {
+            // the other side fell back to the relay, so answer the same way
+            webrtcSignal.relay = true;
+            webrtcSignal.remote = msg.from;
+            webrtcOnData(msg.data);
         } else if (msg.type === "ice") {
             if (!webrtcSignal.pc) {
                 // store candidate until pc exists
@@ -2781,6 +3131,37 @@ async function handleSignalMessage(msg) {
                     console.warn("addIceCandidate failed", e);
                 }
             }
+        } else if (msg.type === "peer-joined") {
+            if (msg.data && msg.data.sameNetwork) webrtcSignal.sameNetwork.push(msg.data.name);
+        } else if (msg.type === "state-changed") {
+            const {key, ...entry} = msg.data;
+            if (entry.value === null) delete webrtcSignal.state.entries[key];
+            else webrtcSignal.state.entries[key] = entry;
+            webrtcSignal.state.version = Math.max(webrtcSignal.state.version, entry.version);
+        } else if (msg.type === "drop-ready") {
+            const file = await webrtcFetchDrop(msg.data);
+            if (file) console.log("webrtc file received:", file.name, file.size);
+        } else if (msg.type === "device-paired") {
+            await db.webrtcDevices.put({id: msg.data.device.id, name: msg.data.device.name});
+        } else if (msg.type === "host-changed") {
+            webrtcSignal.host = msg.data && msg.data.name;
+        } else if (msg.type === "peer-left" || msg.type === "peer-timed-out" ||
+            (msg.type === "peer-kicked" && msg.data && msg.data.name !== webrtcSignal.name)) {
+            // server presence event: the other device is gone, drop the stale connection
+            if (webrtcSignal.pc) {
+                try {
+                    webrtcSignal.pc.close();
+                } catch (_) {
+                }
+            }
+            webrtcSignal.pc = null;
+            webrtcSignal.dc = null;
+            webrtcSignal.relay = false;
+            webrtcSignal.remote = null;
+            webrtcSignal.pendingCandidates = [];
+        } else if (msg.type === "room-closed" || msg.type === "peer-kicked") {
+            // our token died with the room, so there is nothing to leave
+            webrtcGone();
         }
     } catch (e) {
         console.error("handleSignalMessage error", e);
@@ -2832,8 +3213,8 @@ async function translateOther(text, sourceLang, targetLang) {
     });
 }
 
-function addToCommentsQueue(domain, status, access, callback) {
-    commentsQueue.push({domain, status, access, callback});
+function addToCommentsQueue(domain, status, account, callback) {
+    commentsQueue.push({domain, status, account, callback});
     if (!processingComments) {
         processQueue();
     }
@@ -2848,7 +3229,7 @@ async function processQueue() {
     processingComments = true;
     const item = commentsQueue.shift();
     try {
-        await getComments(item.domain, item.status, item.access).then(async (comments) => {
+        await getComments(item.domain, item.status, item.account).then(async (comments) => {
             await item.callback(comments, item.status);
         });
     } catch (e) {